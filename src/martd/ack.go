@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+	Acks are for one2one channels with AckTimeout set. A message handed to a
+	client via Sub is leased to it, and the client has to Ack it within
+	AckTimeout. If it does not, or it is reaped before acking, the message is
+	published again for some other client to pick up. A long polling client
+	unsubscribes as soon as it has its message, so leases are for its cid,
+	see SubOptions, and not its evch, and it acks with /ack, passing that.
+
+	A requeued message gets a fresh etag, so it sorts after everything
+	already in the channel. A late Ack for the old etag is then a no-op.
+
+	Messages taken by a client catching up, via PollOptions or a Sub
+	answered right away, are leased to it too. Those read via Poll or
+	PollFilter are not, they are gone once read.
+
+	Deleting or expiring a channel drops its leases, nothing is requeued
+	into a channel that is gone.
+*/
+
+type lease struct {
+	m     *Message
+	cid   string
+	sub   *Subscriber
+	timer *time.Timer
+}
+
+// lease marks m as in flight to sub. Must be called with c.lock held.
+func (c *Channel) lease(m *Message, sub *Subscriber) {
+	if c.inflight == nil {
+		c.inflight = make(map[int64]*lease)
+	}
+
+	etag := m.Created
+	c.inflight[etag] = &lease{
+		m: m, cid: sub.cid, sub: sub,
+		timer: time.AfterFunc(c.AckTimeout, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			c.requeue(etag)
+		}),
+	}
+}
+
+// leaseTaken leases the messages of cr, taken from the channel by a client
+// catching up, to sub, if the channel wants acks. Must be called with
+// c.lock held.
+func (c *Channel) leaseTaken(cr *ChanResponse, sub *Subscriber) {
+	if !c.One2One || c.AckTimeout == 0 || cr == nil {
+		return
+	}
+	for _, m := range cr.msgs {
+		// keep it on disk till acked, Empty cleared it from the wal too
+		Persist(c, m, nil)
+		if err := WALAppend(c, m); err != nil {
+			warnf("could not log leased message of %s to wal: %s", c.Name, err)
+		}
+		c.lease(m, sub)
+	}
+}
+
+// Ack tells the channel the client cid is done with the message with given
+// etag. Acking a message that is not in flight, say a second time, is not an
+// error.
+func (c *Channel) Ack(etag int64, cid string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	l, ok := c.inflight[etag]
+	if !ok {
+		return nil
+	}
+	if l.cid != cid {
+		return ErrWrongClient
+	}
+
+	l.timer.Stop()
+	delete(c.inflight, etag)
+	Persist(c, nil, l.m)
+	walLog(c, walTake, etag)
+	c.roomFreed()
+	c.checkDrained()
+	return nil
+}
+
+// requeue publishes the leased message again. Must be called with c.lock
+// held.
+func (c *Channel) requeue(etag int64) {
+	l, ok := c.inflight[etag]
+	if !ok || c.deleted {
+		return
+	}
+	l.timer.Stop()
+	delete(c.inflight, etag)
+
+	m := &Message{
+		Data: l.m.Data, Created: c.nextEtag(Clock()),
+		ID: l.m.ID, Headers: l.m.Headers, gzipped: l.m.gzipped,
+	}
+	c.makeRoom(uint(len(m.Data)))
+	old, _ := c.Messages.Push(m)
+	Persist(c, nil, l.m)
+	if err := WALAppend(c, m); err != nil {
+		warnf("could not log requeued message of %s to wal: %s", c.Name, err)
+	}
+	walLog(c, walTake, etag)
+	c.pubOne(m, old)
+}
+
+// stopLeases drops all leases, for a channel that is going away. Must be
+// called with c.lock held.
+func (c *Channel) stopLeases() {
+	for _, l := range c.inflight {
+		l.timer.Stop()
+	}
+	c.inflight = nil
+}
+
+// requeueClient requeues everything leased to sub. Must be called with
+// c.lock held.
+func (c *Channel) requeueClient(sub *Subscriber) {
+	for etag, l := range c.inflight {
+		if l.sub == sub {
+			c.requeue(etag)
+		}
+	}
+}
+
+// AckHandler acks a message, /ack?channel=foo&etag=...&cid=..., with key
+// if the channel has one. cid has to be the one the client subscribed with.
+// It answers with the channel's stats, like SealHandler.
+func AckHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if err := ValidateChannelName(channel); err != nil {
+		reject(w, err.Error())
+		return
+	}
+	etag := int64(0)
+	if _, err := fmt.Sscan(r.FormValue("etag"), &etag); err != nil {
+		reject(w, "invalid etag: "+err.Error())
+		return
+	}
+
+	ch := existingChannel(channel)
+	if ch == nil {
+		rejectStatus(w, ErrChannelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := ch.CheckKey(r.FormValue("key")); err != nil {
+		reject(w, err.Error())
+		return
+	}
+	if err := ch.Ack(etag, r.FormValue("cid")); err != nil {
+		rejectStatus(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	j, err := ch.StatsJson(r.FormValue("etags") == "number")
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustCreateAcked(t *testing.T, name string) *Channel {
+	t.Helper()
+	ch, err := GetOrCreateChannel(name, ChannelOptions{
+		Size: 10, One2One: true, AckTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+// take polls c as client cid, failing unless it gets want messages.
+func take(t *testing.T, c *Channel, cid string, want int) *ChanResponse {
+	t.Helper()
+	cr, _ := c.PollOptions(0, SubOptions{CID: cid})
+	got := 0
+	if cr != nil {
+		got = len(cr.msgs)
+	}
+	if got != want {
+		t.Fatalf("took %d messages, want %d", got, want)
+	}
+	return cr
+}
+
+func TestLeaseRequeue(t *testing.T) {
+	withWAL(t)
+	c := mustCreateAcked(t, "test/acked")
+	pubN(t, c, 2)
+
+	cr := take(t, c, "a", 2)
+	take(t, c, "b", 0)
+	if err := c.Ack(cr.msgs[0].Created, "b"); err != ErrWrongClient {
+		t.Fatalf("acked someone else's message: %v", err)
+	}
+	if err := c.Ack(cr.msgs[0].Created, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cr = take(t, c, "b", 1)
+	if string(cr.msgs[0].Payload()) != "hello" {
+		t.Fatalf("requeued %q", cr.msgs[0].Payload())
+	}
+}
+
+func TestLeaseSurvivesRestart(t *testing.T) {
+	withWAL(t)
+	c := mustCreateAcked(t, "test/acked")
+	pubN(t, c, 1)
+	take(t, c, "a", 1)
+
+	restart(t)
+	take(t, GetChannel("test/acked"), "a", 1)
+}
+
+func TestLeaseAfterDelete(t *testing.T) {
+	withWAL(t)
+	c := mustCreateAcked(t, "test/acked")
+	pubN(t, c, 1)
+	take(t, c, "a", 1)
+	DeleteChannel("test/acked")
+
+	time.Sleep(100 * time.Millisecond)
+	if len(c.Messages.Snapshot()) != 0 {
+		t.Fatal("requeued into a deleted channel")
+	}
+	restart(t)
+	if ChannelExists("test/acked") {
+		t.Fatal("requeue brought back a deleted channel")
+	}
+}
+
+func TestLeaseInSnapshot(t *testing.T) {
+	withWAL(t)
+	c := mustCreateAcked(t, "test/acked")
+	pubN(t, c, 3)
+	cr := take(t, c, "a", 3)
+	if err := c.Ack(cr.msgs[1].Created, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ack(cr.msgs[2].Created, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	restart(t)
+	got := take(t, GetChannel("test/acked"), "b", 1)
+	if got.msgs[0].Created != cr.msgs[0].Created {
+		t.Fatalf("restored %d, want %d", got.msgs[0].Created, cr.msgs[0].Created)
+	}
+}
+
+func TestLeaseConcurrent(t *testing.T) {
+	t.Cleanup(ResetChannels)
+	const n, consumers = 200, 4
+	c, err := GetOrCreateChannel("test/acked", ChannelOptions{
+		Size: n, One2One: true, AckTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := c.Pub([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock, acked := sync.Mutex{}, map[string]bool{}
+	done := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(acked) == n
+	}
+	wg := sync.WaitGroup{}
+	for k := 0; k < consumers; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			cid := fmt.Sprint("consumer ", k)
+			for deadline := time.Now().Add(5 * time.Second); !done(); {
+				if time.Now().After(deadline) {
+					t.Errorf("%s timed out", cid)
+					return
+				}
+				cr, _ := c.PollOptions(0, SubOptions{CID: cid})
+				if cr == nil {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				for i, m := range cr.msgs {
+					if k == 0 && i%2 == 0 {
+						continue // left to time out and be requeued
+					}
+					if err := c.Ack(m.Created, cid); err != nil {
+						t.Error(err)
+						return
+					}
+					lock.Lock()
+					acked[string(m.Payload())] = true
+					lock.Unlock()
+				}
+			}
+		}(k)
+	}
+	wg.Wait()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if left := len(c.Messages.Snapshot()) + len(c.inflight); left != 0 {
+		t.Fatalf("%d messages left after all were acked", left)
+	}
+}
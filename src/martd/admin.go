@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+/*
+	Admin endpoints are for operators, to get rid of a misbehaving channel
+	right away, like one flooded with bad data. They work on any channel,
+	whatever its key, so they need -admin-key instead, passed as
+	admin_key, and are off without it.
+
+	DELETE /channels/{name} deletes the channel, its subscribers are told
+	it is gone. POST /channels/{name}/flush drops all its messages, its
+	subscribers stay.
+*/
+
+var AdminKey string
+
+func init() {
+	flag.StringVar(
+		&AdminKey, "admin-key", "",
+		"Key for the admin endpoints, they are off without one.",
+	)
+}
+
+// CheckAdminKey tells if key is the admin key.
+func CheckAdminKey(key string) error {
+	if AdminKey == "" ||
+		subtle.ConstantTimeCompare([]byte(AdminKey), []byte(key)) != 1 {
+		warnf("bad admin key")
+		return ErrBadAdminKey
+	}
+	return nil
+}
+
+// AdminChannelHandler serves DELETE /channels/{name} and
+// POST /channels/{name}/flush.
+func AdminChannelHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/channels/")
+	flush := false
+	switch r.Method {
+	case "DELETE":
+	case "POST":
+		if !strings.HasSuffix(name, "/flush") {
+			rejectStatus(w, "not found", http.StatusNotFound)
+			return
+		}
+		name, flush = strings.TrimSuffix(name, "/flush"), true
+	default:
+		rejectStatus(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := CheckAdminKey(r.FormValue("admin_key")); err != nil {
+		rejectStatus(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := ValidateChannelName(name); err != nil {
+		reject(w, err.Error())
+		return
+	}
+	ch := existingChannel(name)
+	if ch == nil {
+		rejectStatus(w, ErrChannelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if flush {
+		if err := ch.Clear(); err != nil {
+			rejectStatus(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		infof("channel flushed by admin: %s", name)
+	} else {
+		DeleteChannel(name)
+		infof("channel deleted by admin: %s", name)
+	}
+
+	// for delete, the stats are of the channel as it was deleted
+	j, err := ch.StatsJson(r.FormValue("etags") == "number")
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
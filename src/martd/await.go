@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	PubAwait is for request/response over a channel: the publisher waits
+	till its message has been handed to enough subscribers. A message is
+	handed over when it is sent on a subscriber's evch, or put in the
+	response of a client catching up, so subscribers that come along after
+	the push, within the timeout, count too. A client getting it twice
+	counts twice. Recent does not count, it is not subscribing. PubAwait
+	waits with no lock held, while the channel's sender sends to the
+	subscribers already there, see fanout.go.
+
+	A publisher over HTTP waits at most MaxAwaitTimeout, so it can not hold
+	on to a connection, and its message, for ever.
+*/
+
+var MaxAwaitTimeout time.Duration
+
+func init() {
+	flag.DurationVar(
+		&MaxAwaitTimeout, "max-await-timeout", time.Minute,
+		"Longest await_timeout a publisher can ask for.",
+	)
+}
+
+type awaiter struct {
+	n    int32 // times handed over, atomic
+	want int32
+	done chan struct{} // closed once n reaches want
+}
+
+// handed counts one more hand over of m, if someone is waiting for it.
+func (m *Message) handed() {
+	a := m.await
+	if a != nil && atomic.AddInt32(&a.n, 1) == a.want {
+		close(a.done)
+	}
+}
+
+// PubAwait is Pub, and then waits for the message to be handed to at least
+// minDelivered subscribers, or timeout. It returns how many got it, with
+// ErrAwaitTimeout if that is not enough.
+func (c *Channel) PubAwait(
+	data []byte, minDelivered int, timeout time.Duration,
+) (int, error) {
+	a := newAwaiter(minDelivered)
+	if _, err := c.pubAwait(data, a); err != nil {
+		return 0, err
+	}
+	return a.wait(timeout)
+}
+
+func newAwaiter(want int) *awaiter {
+	return &awaiter{want: int32(want), done: make(chan struct{})}
+}
+
+// wait waits for the message to be handed over a.want times, or timeout,
+// and returns how many times it was.
+func (a *awaiter) wait(timeout time.Duration) (int, error) {
+	if a.want <= 0 {
+		return int(atomic.LoadInt32(&a.n)), nil
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-a.done:
+		return int(atomic.LoadInt32(&a.n)), nil
+	case <-t.C:
+		return int(atomic.LoadInt32(&a.n)), ErrAwaitTimeout
+	}
+}
+
+// pubAwait is Pub, with a waiting for the message. It is queued for all
+// subscribers there now once it returns.
+func (c *Channel) pubAwait(data []byte, a *awaiter) (int64, error) {
+	opts := c.options()
+	if err := opts.check(data); err != nil {
+		return 0, err
+	}
+	if !c.limiter.allow(1, opts.Rate, opts.Burst) {
+		return 0, ErrRateLimited
+	}
+
+	// has to happen before we lock c, it may lock other channels
+	if err := reserveMemory(uint(len(data))); err != nil {
+		return 0, err
+	}
+	defer releaseMemory(uint(len(data)))
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	m, old, err := c.push(data, 0, "", nil, false)
+	if err != nil {
+		return 0, err
+	}
+	m.await = a
+
+	if c.One2One {
+		c.pubOne(m, old)
+		return m.Created, nil
+	}
+
+	Persist(c, m, old)
+	c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(data)})
+	return m.Created, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAwaitCountsSubscribersOnly(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	evch := make(chan *ChannelEvent, 1)
+	if err := c.Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newAwaiter(2)
+	etag, err := c.pubAwait([]byte("hello"), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv(t, evch)
+	c.Recent(10)
+	if n, err := a.wait(10 * time.Millisecond); n != 1 || err != ErrAwaitTimeout {
+		t.Fatalf("after Recent, wait = %d, %v, want 1, ErrAwaitTimeout", n, err)
+	}
+
+	// one catching up after the push counts
+	if _, has := c.Poll(etag - 1); !has {
+		t.Fatal("Poll has nothing")
+	}
+	if n, err := a.wait(time.Second); n != 2 || err != nil {
+		t.Fatalf("after Poll, wait = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func benchChannel(name string, size uint) *Channel {
+	return benchChannelOpts(name, ChannelOptions{Size: size})
+}
+
+func benchChannelOpts(name string, opts ChannelOptions) *Channel {
+	DeleteChannel(name)
+	ch, err := GetOrCreateChannel(name, opts)
+	if err != nil {
+		panic(err)
+	}
+	return ch
+}
+
+func BenchmarkPub(b *testing.B) {
+	ch := benchChannel("bench/pub", 100)
+	defer DeleteChannel(ch.Name)
+	data := []byte("hello")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch.Pub(data)
+	}
+}
+
+// BenchmarkPubPoll publishes 4K json messages, and reads each back, to
+// measure what compressing them costs.
+func BenchmarkPubPoll(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", compress), func(b *testing.B) {
+			ch := benchChannelOpts(
+				"bench/compress",
+				ChannelOptions{Size: 100, Compress: compress},
+			)
+			defer DeleteChannel(ch.Name)
+			data := bytes.Repeat([]byte(`{"hello": "world"},`), 4096/19)
+
+			etag, _ := ch.Pub(data)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				prev := etag
+				etag, _ = ch.Pub(data)
+				ch.Poll(prev)
+			}
+		})
+	}
+}
+
+// BenchmarkHasNew looks for an etag half way through a full channel, which
+// is a binary search over the circular array.
+func BenchmarkHasNew(b *testing.B) {
+	for _, size := range []uint{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			ch := benchChannel("bench/hasnew", size)
+			defer DeleteChannel(ch.Name)
+
+			etag := int64(0)
+			for i := uint(0); i < size; i++ {
+				e, _ := ch.Pub([]byte("hello"))
+				if i == size/2 {
+					etag = e
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch.HasNew(etag)
+			}
+		})
+	}
+}
+
+// BenchmarkFanout measures Pub to n stream subscribers, each read by its
+// own goroutine, so it includes queueing the deliveries but not waiting
+// for them.
+func BenchmarkFanout(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			ch := benchChannel("bench/fanout", 100)
+			defer DeleteChannel(ch.Name)
+
+			done := make(chan struct{})
+			defer close(done)
+			for i := 0; i < n; i++ {
+				evch := make(chan *ChannelEvent, 1)
+				sub := newSubscriber(done)
+				sub.stream = true
+				if err := ch.sub(evch, sub); err != nil {
+					b.Fatal(err)
+				}
+				go func() {
+					for {
+						select {
+						case <-evch:
+						case <-done:
+							return
+						}
+					}
+				}()
+			}
+			data := []byte("hello")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch.Pub(data)
+			}
+		})
+	}
+}
+
+func BenchmarkGetChannelParallel(b *testing.B) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench/get/%d", i)
+		GetChannel(names[i])
+	}
+	defer func() {
+		for _, name := range names {
+			DeleteChannel(name)
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			GetChannel(names[i%len(names)])
+			i++
+		}
+	})
+}
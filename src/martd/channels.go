@@ -1,39 +1,136 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
-	"sync"
-	"time"
-	"log"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"github.com/amitu/gutils"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Message struct {
 	Data    []byte
-	Created int64 // created time acts as the etag
+	Created int64             // created time acts as the etag
+	ID      string            // given by the publisher, if any
+	Headers map[string]string `json:",omitempty"` // given by the publisher
+	gzipped bool              // Data is, use Payload to read it
+	await   *awaiter          // of PubAwait, if any
+}
+
+// ChannelOptions are set by whoever creates the channel.
+type ChannelOptions struct {
+	Size           uint          `json:"size"`
+	Life           time.Duration `json:"life"`
+	Key            string        `json:"key,omitempty"`
+	One2One        bool          `json:"one2one"`
+	Latest         bool          `json:"latest,omitempty"`          // last write wins
+	AckTimeout     time.Duration `json:"ack_timeout,omitempty"`     // one2one only
+	MaxSubscribers uint          `json:"max_subscribers,omitempty"` // 0 for no limit
+	Binary         bool          `json:"binary,omitempty"`          // base64 payloads
+	JSON           bool          `json:"json,omitempty"`            // reject invalid json
+	Compress       bool          `json:"compress,omitempty"`        // gzip in memory
+	Rate           float64       `json:"rate,omitempty"`            // messages/sec, 0 for any
+	Burst          uint          `json:"burst,omitempty"`           // with Rate
+	Coalesce       time.Duration `json:"coalesce,omitempty"`        // see coalesce.go
+	// 0 means no limit for these two
+	MaxMsgBytes uint   `json:"max_msg_bytes,omitempty"` // size of one message
+	MaxBytes    uint   `json:"max_bytes,omitempty"`     // all buffered messages
+	Webhook     string `json:"webhook,omitempty"`       // url messages are POSTed to
+	Full        string `json:"full,omitempty"`          // see full.go
 }
 
 type Channel struct {
-	Name     string                      `json:"name"`
-	Size     uint                        `json:"size"`
-	Life     time.Duration               `json:"life"`
-	Key      string                      `json:"key,omitempty"`
-	Clients  map[chan *ChannelEvent]bool `json:"-"`
-	Messages *CircularMessageArray       `json:"-"`
-	One2One  bool                        `json:"one2one"`
-	lock     sync.RWMutex                `json:"-"`
-	inited   bool
+	ChannelOptions
+	Name        string                             `json:"name"`
+	Clients     map[chan *ChannelEvent]*Subscriber `json:"-"`
+	Messages    *CircularMessageArray              `json:"-"`
+	SendTimeout time.Duration                      `json:"send_timeout"` // slow clients
+	lock        sync.RWMutex                       `json:"-"`
+	inited      bool
+	active      time.Time   // last Pub, channel is dropped Life after this
+	reaper      *time.Timer // nil if channel never expires
+	inflight    map[int64]*lease
+	lastEtag    int64 // etags only ever go up, see nextEtag
+	limiter     rateLimiter
+	urgent      *CircularMessageArray // priority lane, nil till used
+	pending     [][]delivery          // fanouts unlock has to queue
+	outbox      [][]delivery          // what the sender has to send, in order
+	sending     bool                  // the sender is running, see fanout.go
+	sealed      bool                  // takes no more messages, see Seal
+	deleted     bool                  // out of its shard, see remove
+	draining    bool                  // sealed and empty, being deleted
+	hookFailed  int64                 // messages the webhook missed, atomic
+	detached    bool                  // made by NewChannel
+	sendLatency latency               // from push to send, see latency.go
+	fanoutTime  latency               // of sending to all subscribers
+	coalescer   *time.Timer           // nil if no coalesce window is open
+	held        *Message              // latest Pub of the coalesce window
+	lastPub     time.Time             // zero if never published to
+	lastSub     time.Time             // zero if never subscribed to
+	relayed     bool                  // has messages from a peer, see peers.go
+	roomCond    *sync.Cond            // pushes waiting for room, see full.go
+	nClients    int32                 // len(Clients), atomic, see maxchannels.go
+	lruElem     *list.Element         // in lru, see maxchannels.go
 }
 
+// ChannelEvent is what clients get on their event channel. Mesg is nil if
+// the channel is gone, Drained too if it was sealed and has been emptied,
+// or if this is just a heartbeat, or the server is shutting down, or the
+// client was reaped, having waited too long. For PubBatch, Batch has all
+// the messages and Mesg is the newest of them.
 type ChannelEvent struct {
-	Chan *Channel
-	Mesg *Message
+	Chan      *Channel
+	Mesg      *Message
+	Batch     []*Message
+	Heartbeat bool
+	Shutdown  bool
+	Drained   bool
+	Reaped    bool
+}
+
+// handed counts the messages of ev as handed over, see PubAwait.
+func (ev *ChannelEvent) handed() {
+	for _, m := range ev.Messages() {
+		m.handed()
+	}
+}
+
+// Messages returns all messages in the event, oldest first.
+func (ev *ChannelEvent) Messages() []*Message {
+	if ev.Batch != nil {
+		return ev.Batch
+	}
+	if ev.Mesg != nil {
+		return []*Message{ev.Mesg}
+	}
+	return nil
 }
 
 var (
-	Channels    map[string]*Channel
-	ChannelLock sync.RWMutex
+	SendTimeout  time.Duration
+	nPublished   = expvar.NewInt("nPublished")
+	nSubscribed  = expvar.NewInt("nSubscribed")
+	nDelivered   = expvar.NewInt("nDelivered")
+	nDropped     = expvar.NewInt("nDropped")
+	nClosedSubs  = expvar.NewInt("nClosedSubs")
+	nReaped      = expvar.NewInt("nReaped")
+	SubMaxAge    time.Duration
+	DefaultSize  uint
+	DefaultLife  time.Duration
+	MaxSubBuffer int
 )
 
 var (
@@ -41,8 +138,65 @@ var (
 )
 
 func init() {
-	Channels = make(map[string]*Channel)
+	flag.DurationVar(
+		&SendTimeout, "send-timeout", time.Second,
+		"How long to wait on a slow client before dropping it.",
+	)
+	flag.DurationVar(
+		&SubMaxAge, "sub-max-age", 0,
+		"Drop clients waiting for longer than this (0 for never).",
+	)
+	flag.IntVar(
+		&MaxSubBuffer, "max-sub-buffer", 1024,
+		"Most events a subscriber can ask to have buffered.",
+	)
+	flag.UintVar(
+		&DefaultSize, "default-size", 10,
+		"Size of channels created without one.",
+	)
+	flag.DurationVar(
+		&DefaultLife, "default-life", time.Hour,
+		"Life of channels created without a size or life.",
+	)
 	go PeriodicExpireMessages()
+	go PeriodicReapSubscribers()
+}
+
+func PeriodicReapSubscribers() {
+	for {
+		time.Sleep(30 * time.Second)
+		ReapSubscribers()
+	}
+}
+
+// ReapSubscribers drops clients that have gone away without unsubscribing.
+// One shot clients still waiting are kicked, with Reaped set, so they
+// answer, stream ones are told they lagged.
+func ReapSubscribers() {
+	now := time.Now()
+	eachChannel(func(ch *Channel) {
+		ch.lock.Lock()
+		kicks := []delivery{}
+		for evch, sub := range ch.Clients {
+			if sub.gone(now) {
+				ch.delClient(evch)
+				ch.requeueClient(sub)
+				if !sub.stream {
+					kicks = append(kicks, delivery{
+						evch: evch, sub: sub,
+						ev: &ChannelEvent{Chan: ch, Reaped: true},
+					})
+				}
+				sub.lag()
+				nReaped.Add(1)
+				if Log != nil {
+					Log.Debugf("reaped subscriber of %s", ch.Name)
+				}
+			}
+		}
+		ch.queue(kicks)
+		ch.lock.Unlock()
+	})
 }
 
 func PeriodicExpireMessages() {
@@ -52,43 +206,406 @@ func PeriodicExpireMessages() {
 	}
 }
 
-func GetOrCreateChannel(
-	name string, size uint, life time.Duration, one2one bool, key string,
-) (*Channel, error) {
-	ChannelLock.Lock()
-	defer ChannelLock.Unlock()
+// ChannelNameRe and ChannelNameMaxLen decide what names can be used for
+// channels.
+var (
+	ChannelNameRe     = regexp.MustCompile(`^[a-zA-Z0-9_./:-]+$`)
+	ChannelNameMaxLen = 256
+)
+
+func ValidateChannelName(name string) error {
+	if len(name) > ChannelNameMaxLen || !ChannelNameRe.MatchString(name) {
+		return ErrBadChannelName
+	}
+	return nil
+}
+
+// normalized returns o the way a channel created with it would have it. A
+// Size of 0 asks for the defaults, -default-size, and -default-life too if
+// Life is 0 as well.
+func (o ChannelOptions) normalized() ChannelOptions {
+	if o.Size == 0 {
+		o.Size = DefaultSize
+		if o.Life == 0 {
+			o.Life = DefaultLife
+		}
+	}
+	if o.Latest {
+		o.Size = 1
+	}
+	if o.Full == "overwrite" {
+		o.Full = ""
+	}
+	return o
+}
+
+func (o ChannelOptions) Validate() error {
+	if o.normalized().Size == 0 {
+		return ErrBadSize
+	}
+	if o.Webhook != "" && !validWebhook(o.Webhook) {
+		return ErrBadWebhook
+	}
+	full := o.normalized().Full
+	if !validFull(o.Full) || (full != "" && (!o.One2One || o.Latest)) {
+		return ErrBadFull
+	}
+	return nil
+}
+
+func GetOrCreateChannel(name string, opts ChannelOptions) (*Channel, error) {
+	ch, _, err := CreateChannel(name, opts)
+	return ch, err
+}
+
+// CreateChannel gets or creates a channel, created tells if it is new. If
+// the channel exists already with other options it is returned along with
+// ErrChannelExists, its options are left alone, see SetOptions.
+func CreateChannel(
+	name string, opts ChannelOptions,
+) (ch *Channel, created bool, err error) {
+	if err := opts.Validate(); err != nil {
+		return nil, false, err
+	}
+	if opts, err = namespaced(name, opts); err != nil {
+		return nil, false, err
+	}
+	ch, created, err = getOrCreateChannel(name, opts)
+	if err != nil || created {
+		return ch, created, err
+	}
+
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	if ch.ChannelOptions != opts.normalized() {
+		return ch, false, ErrChannelExists
+	}
+	return ch, false, nil
+}
+
+// getOrCreateChannel does not care what options an existing channel has,
+// for loading channels back, whose options may have changed over time.
+func getOrCreateChannel(
+	name string, opts ChannelOptions,
+) (*Channel, bool, error) {
+	if err := ValidateChannelName(name); err != nil {
+		return nil, false, err
+	}
+	for {
+		// has to happen before we lock, it locks others
+		if existingChannel(name) == nil && !makeRoomForChannel() {
+			return nil, false, ErrTooManyChannels
+		}
+		ch, created, err := createChannel(name, opts)
+		if err == ErrTooManyChannels && evicting() {
+			continue // another channel took the room made, make more
+		}
+		return ch, created, err
+	}
+}
+
+// createChannel is getOrCreateChannel, once there is room for the channel.
+func createChannel(
+	name string, opts ChannelOptions,
+) (*Channel, bool, error) {
+	// a channel must not come up between SubPattern looking for matching
+	// channels and adding its pattern
+	PatternLock.RLock()
+	defer PatternLock.RUnlock()
+
+	s := shardOf(name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ch := s.channels[name]; ch != nil && ch.inited {
+		return ch, false, nil
+	}
+	if err := reserveChannel(); err != nil {
+		return nil, false, err
+	}
 
 	ch := GetChannel_(name)
+	ch.lock.Lock()
+	ch.init(opts)
+	infof(
+		"channel created: %s size=%d life=%s one2one=%v",
+		name, ch.Size, ch.Life, ch.One2One,
+	)
+	ch.unlock()
+	lruAdd(ch)
+	ch.subPatterns()
+	channelCreated(ch)
 
-	if !ch.inited {
-		ch.inited = true
-		ch.Size = size
-		ch.Life = life
-		ch.One2One = one2one
-		ch.Key = key
-		ch.Messages = NewCircularMessageArray(size)
+	return ch, true, nil
+}
+
+// NewChannel returns a channel of its own, not in the list of channels, so
+// no one else can find it by name, and it is not persisted. Meant for
+// tests, and for using channels in process. opts are not validated, a size
+// of 0 gets the default.
+func NewChannel(opts ChannelOptions) *Channel {
+	ch := shellChannel("")
+	ch.detached = true
+	ch.init(opts)
+	return ch
+}
+
+// init sets up a shell channel with opts, subscribers already waiting on it
+// stay. Must be called with c.lock held, or before anyone else has c.
+func (c *Channel) init(opts ChannelOptions) {
+	opts = opts.normalized()
+	if c.reaper != nil {
+		c.reaper.Stop() // it would drop the shell, see dropShell
+		c.reaper = nil
+	}
+	c.inited = true
+	c.ChannelOptions = opts
+	c.Messages = NewCircularMessageArray(opts.Size)
+	c.active = time.Now()
+	if opts.Life != 0 {
+		c.reaper = time.AfterFunc(opts.Life, c.expire)
+	}
+}
+
+// existingChannel returns the channel called name, or nil if there is none,
+// without creating it.
+func existingChannel(name string) *Channel {
+	s := shardOf(name)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ch := s.channels[name]
+	if ch == nil || !ch.inited {
+		return nil
+	}
+	return ch
+}
+
+// ChannelExists tells if channel name has been created, or published to,
+// without creating it. Subscribers waiting on a channel do not make it
+// exist.
+func ChannelExists(name string) bool {
+	return existingChannel(name) != nil
+}
+
+// peekChannel is GetChannel for reading only: if there is no channel called
+// name it returns an empty one, like GetChannel would, but does not keep it.
+func peekChannel(name string) *Channel {
+	s := shardOf(name)
+	s.lock.RLock()
+	ch, ok := s.channels[name]
+	s.lock.RUnlock()
+	if ok {
+		return ch
 	}
+	return shellChannel(name)
+}
+
+// ListChannels returns sorted names of all channels.
+func ListChannels() []string {
+	return ListChannelsPrefix("")
+}
 
-	return ch, nil
+// ListChannelsPrefix returns sorted names of channels starting with prefix.
+func ListChannelsPrefix(prefix string) []string {
+	names := []string{}
+	eachChannel(func(ch *Channel) {
+		if strings.HasPrefix(ch.Name, prefix) {
+			names = append(names, ch.Name)
+		}
+	})
+	sort.Strings(names)
+	return names
 }
 
 func GetChannel(name string) *Channel {
-	ChannelLock.Lock()
-	defer ChannelLock.Unlock()
+	s := shardOf(name)
+	s.lock.RLock()
+	ch, ok := s.channels[name]
+	s.lock.RUnlock()
+	if ok {
+		return ch
+	}
+
+	// GetChannel_ looks again, someone may have created it by now
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return GetChannel_(name)
 }
 
+// GetChannel_ is GetChannel, with the shard of name locked.
 func GetChannel_(name string) *Channel {
-	ch, ok := Channels[name]
+	s := shardOf(name)
+	ch, ok := s.channels[name]
 	if !ok {
-		ch = &Channel{Name: name, Clients: make(map[chan *ChannelEvent]bool)}
-		Channels[name] = ch
-
-		// TODO spawn a goroutine to delete this channel?
+		ch = shellChannel(name)
+		s.channels[name] = ch
 	}
 	return ch
 }
 
+// shellChannel makes a channel called name that subscribers can wait on,
+// it is set up once created or published to.
+func shellChannel(name string) *Channel {
+	return &Channel{
+		Name: name, Clients: make(map[chan *ChannelEvent]*Subscriber),
+		SendTimeout: SendTimeout,
+	}
+}
+
+// shellLinger is how long a shell channel no one waits on is kept, for
+// clients that got it from GetChannel and are about to subscribe.
+var shellLinger = time.Minute
+
+// dropShell removes shell channel c from its shard, unless it was set up,
+// or someone subscribed, since its last client left. Shells are not counted
+// against -max-channels, this keeps clients that wait on made up names from
+// piling them up.
+func (c *Channel) dropShell() {
+	s := shardOf(c.Name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.inited || c.deleted {
+		return
+	}
+	c.reaper = nil
+	if len(c.Clients) != 0 || s.channels[c.Name] != c {
+		return
+	}
+	delete(s.channels, c.Name)
+	c.deleted = true
+}
+
+// expire is called by the reaper timer. If there was a Pub since the timer
+// was armed we just re-arm for the remaining time, else the channel is
+// removed and all clients waiting on it are kicked out.
+func (c *Channel) expire() {
+	s := shardOf(c.Name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.reaper == nil {
+		return // SetOptions made the channel live forever
+	}
+	idle := time.Since(c.active)
+	if idle < c.Life {
+		c.reaper.Reset(c.Life - idle)
+		return
+	}
+
+	log.Println("Channel expired:", c.Name)
+	infof("channel expired: %s", c.Name)
+	if s.channels[c.Name] == c {
+		delete(s.channels, c.Name)
+		channelGone(c)
+		channelDeleted(c.Name)
+		walLog(c, walDelete, 0)
+	}
+	c.deleted = true
+	c.stopLeases()
+	c.Messages.Empty() // frees up memory budget, db expires them on its own
+	c.emptyUrgent()
+	c.stopCoalescing()
+	c.roomFreed()
+	c.kick()
+}
+
+// kick sends every client a ChannelEvent with nil Mesg, telling them the
+// channel is gone, after any fanout still to go out, and drops them. Must be
+// called with c.lock held.
+func (c *Channel) kick() {
+	c.queueAll(&ChannelEvent{Chan: c})
+}
+
+// delClient drops evch, if it was the last client OnLastUnsubscribe hooks
+// are run. Must be called with c.lock held.
+func (c *Channel) delClient(evch chan *ChannelEvent) {
+	if _, ok := c.Clients[evch]; !ok {
+		return
+	}
+	delete(c.Clients, evch)
+	atomic.StoreInt32(&c.nClients, int32(len(c.Clients)))
+	if len(c.Clients) == 0 {
+		lastUnsubscribe(c)
+		if !c.inited && !c.deleted && c.reaper == nil {
+			c.reaper = time.AfterFunc(shellLinger, c.dropShell)
+		}
+	}
+}
+
+// deliver sends ev to a client and drops it from the channel, unless it is
+// a stream subscriber that took ev. Must be called with c.lock held.
+func (c *Channel) deliver(
+	evch chan *ChannelEvent, sub *Subscriber, ev *ChannelEvent,
+) bool {
+	ok := c.send(evch, sub, ev)
+	if ok && ev.Mesg != nil {
+		c.sendLatency.record(Clock() - ev.Mesg.Created)
+	}
+	if ok && sub.stream {
+		return true
+	}
+	c.delClient(evch)
+	if !ok {
+		sub.lag()
+	}
+	return ok
+}
+
+// send hands ev to a client, waiting at most SendTimeout for it. Returns
+// false if the client could not keep up, or has gone away, and the event was
+// dropped. It needs no lock, Name and SendTimeout never change. A client
+// that closed evch, which it must not, is taken as gone too, instead of
+// taking the server down with it.
+func (c *Channel) send(
+	evch chan *ChannelEvent, sub *Subscriber, ev *ChannelEvent,
+) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			nClosedSubs.Add(1)
+			warnf("client of %s closed its channel: %v", c.Name, e)
+			ok = false
+		}
+	}()
+
+	select {
+	case <-sub.done:
+		return false
+	default:
+	}
+
+	select {
+	case evch <- ev:
+		nDelivered.Add(1)
+		ev.handed()
+		return true
+	default:
+	}
+
+	t := time.NewTimer(c.SendTimeout)
+	defer t.Stop()
+
+	select {
+	case evch <- ev:
+		nDelivered.Add(1)
+		ev.handed()
+		return true
+	case <-sub.done:
+		return false
+	case <-t.C:
+		nDropped.Add(1)
+		warnf("dropped slow client of %s", c.Name)
+		return false
+	}
+}
+
 func (c *Channel) ExpireOldMessages(now int64) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -98,134 +615,1228 @@ func (c *Channel) ExpireOldMessages(now int64) {
 		return
 	}
 
+	c.expireOldMessages(now)
+}
+
+// expireOldMessages pops messages older than Life, so readers never see
+// them. Must be called with c.lock held.
+func (c *Channel) expireOldMessages(now int64) {
+	if c.Messages == nil || c.Life == 0 {
+		return
+	}
+
+	c.expireFrom(c.Messages, now)
+	if c.urgent != nil {
+		c.expireFrom(c.urgent, now)
+	}
+	c.checkDrained()
+}
 
+func (c *Channel) expireFrom(lane *CircularMessageArray, now int64) {
 	for {
-		m, err := c.Messages.PeekOldest()
-		if err != nil {
+		m, err := lane.PeekOldest()
+		if err != nil || m == nil {
 			break
 		}
 
-		if m.Created + int64(c.Life) > now {
+		if m.Created+int64(c.Life) > now {
 			break
 		}
 
-		c.Messages.Pop()
+		lane.Pop()
+		c.roomFreed()
 	}
 }
 
-func (c *Channel) Pub(data []byte) int64 {
+func (c *Channel) Pub(data []byte) (int64, error) {
+	opts := c.options()
+	if err := opts.check(data); err != nil {
+		return 0, err
+	}
+	if !c.limiter.allow(1, opts.Rate, opts.Burst) {
+		return 0, ErrRateLimited
+	}
+
+	// has to happen before we lock c, it may lock other channels
+	if err := reserveMemory(uint(len(data))); err != nil {
+		return 0, err
+	}
+	defer releaseMemory(uint(len(data)))
+
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
+
+	if c.Coalesce != 0 && !c.One2One {
+		if etag, held, err := c.coalesce(data); err != nil || held {
+			return etag, err
+		}
+	}
 
-	m := &Message{Data: data, Created: time.Now().UnixNano()}
-	old, _ := c.Messages.Push(m)
+	m, old, err := c.push(data, 0, "", nil, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.One2One {
+		c.pubOne(m, old)
+		return m.Created, nil
+	}
 
 	Persist(c, m, old)
+	c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(data)})
+	return m.Created, nil
+}
+
+// PubBatch publishes all of datas in one go, subscribers get them all in a
+// single event. Nothing is published if any of them is too large.
+func (c *Channel) PubBatch(datas [][]byte) error {
+	if len(datas) == 0 {
+		return nil
+	}
+
+	opts := c.options()
+	size := uint(0)
+	for _, data := range datas {
+		if err := opts.check(data); err != nil {
+			return err
+		}
+		size += uint(len(data))
+	}
+	if !c.limiter.allow(len(datas), opts.Rate, opts.Burst) {
+		return ErrRateLimited
+	}
+
+	if err := reserveMemory(size); err != nil {
+		return err
+	}
+	defer releaseMemory(size)
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	// room for all of them, or none is published
+	if _, err := c.waitRoom(len(datas), size); err != nil {
+		return err
+	}
+
+	batch := make([]*Message, 0, len(datas))
+	for _, data := range datas {
+		m, old, err := c.push(data, 0, "", nil, false)
+		if err != nil {
+			return err
+		}
+
+		if c.One2One {
+			c.pubOne(m, old)
+			continue
+		}
+
+		Persist(c, m, old)
+		batch = append(batch, m.plain(data))
+	}
+
+	if len(batch) != 0 {
+		c.fanout(&ChannelEvent{Chan: c, Mesg: batch[len(batch)-1], Batch: batch})
+	}
+	return nil
+}
+
+// options is a copy of c's options, for use without c.lock held.
+func (c *Channel) options() ChannelOptions {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ChannelOptions
+}
+
+// check tells if data can be published on a channel with options o.
+func (o ChannelOptions) check(data []byte) error {
+	if o.MaxMsgBytes != 0 && uint(len(data)) > o.MaxMsgBytes {
+		return ErrMsgTooLarge
+	}
+	if o.MaxBytes != 0 && uint(len(data)) > o.MaxBytes {
+		return ErrMsgTooLarge
+	}
+	if o.JSON && !json.Valid(data) {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// push adds data to the channel as a new message, returning it and the
+// message it pushed out, if any. etag 0 means pick the next one, else it must
+// be newer than lastEtag. urgent messages go to the priority lane. Must be
+// called with c.lock held.
+func (c *Channel) push(
+	data []byte, etag int64, id string, headers map[string]string,
+	urgent bool,
+) (m, old *Message, err error) {
+	if c.Messages == nil {
+		return nil, nil, ErrChannelNotFound
+	}
+	if c.sealed {
+		return nil, nil, ErrChannelSealed
+	}
+	if !urgent {
+		waited, err := c.waitRoom(1, uint(len(data)))
+		if err != nil {
+			return nil, nil, err
+		}
+		if waited && etag != 0 && etag <= c.lastEtag {
+			return nil, nil, ErrStaleEtag // another push took it meanwhile
+		}
+		if waited && id != "" && c.messageWithID(id) != nil {
+			return nil, nil, errDuplicateID // a retry got in meanwhile
+		}
+	}
+
+	nPublished.Add(1)
+	c.active = time.Now()
+	c.lastPub = c.active
+	channelUsed(c)
+	if etag == 0 {
+		etag = c.nextEtag(Clock())
+	} else {
+		c.lastEtag = etag
+	}
+	m = &Message{Data: data, Created: etag, ID: id, Headers: headers}
+	if Log != nil {
+		Log.Debugf("pub %s %d, %d bytes", c.Name, etag, len(data))
+	}
+	if err := WALAppend(c, m); err != nil {
+		return nil, nil, err
+	}
+	c.webhook(m)
+	if c.Compress {
+		m.compress()
+	}
+	c.expireOldMessages(m.Created)
+	if urgent {
+		if c.urgent == nil {
+			c.urgent = NewCircularMessageArray(c.Size)
+		}
+		old, _ = c.urgent.Push(m)
+		return m, old, nil
+	}
+	c.makeRoom(uint(len(m.Data)))
+	old, _ = c.Messages.Push(m)
+	return m, old, nil
+}
 
-	sentToSome := false
+// nextEtag returns etag for a message created at now. Two messages can be
+// created in the same nanosecond, so if now is not past the last etag handed
+// out, last etag + 1 is used. Must be called with c.lock held.
+func (c *Channel) nextEtag(now int64) int64 {
+	if now <= c.lastEtag {
+		now = c.lastEtag + 1
+	}
+	c.lastEtag = now
+	return now
+}
 
-	for evch, _ := range c.Clients {
-		evch <- &ChannelEvent{c, m}
-		sentToSome = true
+// makeRoom drops oldest messages till n more bytes fit in MaxBytes. Must be
+// called with c.lock held.
+func (c *Channel) makeRoom(n uint) {
+	if c.MaxBytes == 0 {
+		return
 	}
+	for c.Messages.Length() > 0 && c.Messages.Bytes()+n > c.MaxBytes {
+		old, err := c.Messages.Pop()
+		if err != nil {
+			break
+		}
+		Persist(c, nil, old)
+	}
+}
 
-	// we drop this because all clients are supposed to be gone when this
-	// succeeds, not sure if this is race free: TODO
-	c.Clients = make(map[chan *ChannelEvent]bool)
+// pubOne hands m to exactly one client of a one2one channel. Once a client
+// takes it, m is removed from the channel so no one else can claim it. With
+// no (willing) client around m stays in the channel for the next one to pick
+// up via Poll. Must be called with c.lock held.
+func (c *Channel) pubOne(m, old *Message) {
+	for evch, sub := range c.Clients {
+		if !sub.filter.Match(m.Payload()) {
+			continue
+		}
+		if !c.deliver(evch, sub, &ChannelEvent{Chan: c, Mesg: m}) {
+			continue
+		}
 
-	if sentToSome && c.One2One {
-		c.Empty()
+		c.Messages.PopNewest()
+		c.roomFreed()
+		if c.AckTimeout != 0 {
+			// keep it on disk till acked
+			Persist(c, m, old)
+			c.lease(m, sub)
+		} else {
+			walLog(c, walTake, m.Created)
+			if old != nil {
+				Persist(c, nil, old)
+			}
+		}
+		return
 	}
 
-	return m.Created
+	Persist(c, m, old)
 }
 
-func (c *Channel) HasNew(etag int64) (bool, uint) {
+// CheckKey returns ErrBadKey if the channel has a key and key does not match
+// it. Channels created without a key are open to everyone. In a namespace
+// with a key it is the namespace's key that has to match.
+func (c *Channel) CheckKey(key string) error {
+	want := namespaceKey(c.Name)
+	if want == "" {
+		want = c.Key
+	}
+	if want == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(key)) != 1 {
+		warnf("bad key for %s", c.Name)
+		return ErrBadKey
+	}
+	return nil
+}
+
+// PubWithEtag is Pub, with etag chosen by the publisher, so it can retry
+// safely. If the channel already has a message with etag, and the same data,
+// nothing is published and false is returned. etag is a unix time in
+// nanoseconds, like the ones Pub makes, messages expire by it, and it must
+// be newer than any message published so far.
+func (c *Channel) PubWithEtag(data []byte, etag int64) (bool, error) {
+	if etag <= 0 {
+		return false, ErrStaleEtag
+	}
+	opts := c.options()
+	if err := opts.check(data); err != nil {
+		return false, err
+	}
+	if !c.limiter.allow(1, opts.Rate, opts.Burst) {
+		return false, ErrRateLimited
+	}
+
+	// has to happen before we lock c, it may lock other channels
+	if err := reserveMemory(uint(len(data))); err != nil {
+		return false, err
+	}
+	defer releaseMemory(uint(len(data)))
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.Messages == nil {
+		return false, ErrChannelNotFound
+	}
+	// a retry of a push that made it, or a clash with another one
+	retried := func() (bool, error) {
+		i, ok := c.Messages.IndexOfEtag(etag)
+		if !ok {
+			return false, ErrStaleEtag
+		}
+		if m, err := c.Messages.Ith(i); err == nil && bytes.Equal(m.Payload(), data) {
+			return false, nil
+		}
+		return false, ErrEtagConflict
+	}
+	if etag <= c.lastEtag {
+		return retried()
+	}
+
+	m, old, err := c.push(data, etag, "", nil, false)
+	if err == ErrStaleEtag {
+		return retried() // waited for room, and another push got in
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if c.One2One {
+		c.pubOne(m, old)
+		return true, nil
+	}
+
+	Persist(c, m, old)
+	c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(data)})
+	return true, nil
+}
+
+// PubWithKey is Pub for channels that may be protected by a key.
+func (c *Channel) PubWithKey(data []byte, key string) (int64, error) {
+	if err := c.CheckKey(key); err != nil {
+		return 0, err
+	}
+	return c.Pub(data)
+}
+
+// HasNew tells if there is anything after etag, and the index to Append
+// from. The two lock separately, a Pub in between can shift the index, so
+// use Poll unless holding on to ith is fine.
+func (c *Channel) HasNew(etag int64) (has bool, ith uint, lostData bool) {
 	/*
 		etag semantics: if someone has passed etag != 0, means they have some
 		old data, and want everything since then. we may have lost some data
-		by then, but we should not lose anything more.
+		by then, but we should not lose anything more. lostData is set in
+		that case, so the client knows it has fallen behind.
 	*/
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if c.Messages != nil && c.Messages.Length() > 0 {
-		oldest, _ := c.Messages.PeekOldest() // TODO, handle error?
-		if oldest.Created > etag {
-			return true, 0 // oldest
+	c.expireOldMessages(Clock())
+	return c.hasNew(etag)
+}
+
+// hasNew is HasNew, with c.lock held and old messages already expired.
+func (c *Channel) hasNew(etag int64) (has bool, ith uint, lostData bool) {
+	if etag < 0 {
+		etag = 0 // clients can not wedge themselves, they get everything
+	}
+	if c.Messages == nil {
+		return false, 0, false
+	}
+
+	ml := c.Messages.Length()
+	if ml == 0 {
+		return false, 0, false
+	}
+
+	if c.Latest {
+		// whatever etag the client has, it gets the current state
+		newest, err := c.Messages.PeekNewest()
+		if err != nil || newest == nil {
+			return false, 0, false
 		}
+		return newest.Created != etag, ml - 1, false
+	}
 
-		ml := c.Messages.Length()
+	oldest, err := c.Messages.PeekOldest()
+	if err != nil || oldest == nil {
+		return false, 0, false
+	}
+	if oldest.Created > etag {
+		return true, 0, etag != 0 // oldest
+	}
 
-		// find the first message in the channel with .Created == etag.
-		for i := uint(0); i < ml-1; i++ {
-			ith, _ := c.Messages.Ith(i)
-			if etag == ith.Created {
-				return true, i + 1
-			}
+	// messages newer than etag are new, if the newest one is not the client
+	// is up to date. etag need not be one of ours: one past the newest, a
+	// made up one even, is caught up, and the client gets what comes next.
+	ith = c.Messages.IndexAfter(etag)
+	return ith < ml, ith, false
+}
+
+// Subscriber is what the channel knows about each of its clients.
+type Subscriber struct {
+	done  <-chan struct{} // closed when client goes away, nil if it never does
+	since time.Time
+
+	// stream subscribers are not dropped after each message, only when they
+	// fall behind, and then they are told so on lagged.
+	stream bool
+	lagged chan struct{}
+
+	filter   Filter // which messages the client wants, nil for all
+	identity string // who the client is, for Presence, may be empty
+	cid      string // what leases are for, see ack.go
+
+	// one shot subscribers waiting for a MinEtag, and the etag they came
+	// with, see minetag.go
+	min  int64
+	from int64
+}
+
+// SubOptions are what a client can ask for when subscribing, the zero value
+// gets everything, anonymously.
+type SubOptions struct {
+	Filter   Filter
+	Identity string
+	CID      string // client id, for Ack, it outlives any evch
+	Buffer   int    // more events evch can hold, see EventChan
+
+	// messages older than this are left out of the backlog, 0 for none.
+	// Messages published while subscribed are always fresh. One2one
+	// channels send all of them, what one client leaves out is for others.
+	MaxAge time.Duration
+
+	// most messages of the backlog in one response, 0 for all of them. The
+	// etag is that of the last one sent, and More is set, so the client
+	// can ask for the next ones. One2one channels send all of them.
+	MaxBacklog uint
+
+	// etag the channel must have reached before the client is answered,
+	// for seeing its own pushes, 0 for none. See minetag.go.
+	MinEtag int64
+}
+
+// since is the etag of the oldest message the client still wants.
+func (o SubOptions) since() int64 {
+	if o.MaxAge == 0 {
+		return 0
+	}
+	return Clock() - int64(o.MaxAge)
+}
+
+// EventChan makes a channel for events, with room for n events plus Buffer.
+// Publishers only wait on a subscriber whose evch is full, so a buffer lets
+// a busy subscriber take a burst without holding up publishers, or being
+// dropped by them as slow, but what it reads next may have been waiting in
+// the buffer for a while.
+func (o SubOptions) EventChan(n int) chan *ChannelEvent {
+	return make(chan *ChannelEvent, n+o.Buffer)
+}
+
+func (o SubOptions) subscriber(done <-chan struct{}) *Subscriber {
+	sub := newSubscriber(done)
+	sub.filter = o.Filter
+	sub.identity = o.Identity
+	sub.cid = o.CID
+	return sub
+}
+
+// lag tells a stream subscriber it has been dropped and missed messages.
+func (s *Subscriber) lag() {
+	if !s.stream {
+		return
+	}
+	select {
+	case s.lagged <- struct{}{}:
+	default:
+	}
+}
+
+func newSubscriber(done <-chan struct{}) *Subscriber {
+	return &Subscriber{done: done, since: time.Now()}
+}
+
+// gone tells if the client has gone away, or has been waiting for longer
+// than SubMaxAge.
+func (s *Subscriber) gone(now time.Time) bool {
+	if SubMaxAge != 0 && now.Sub(s.since) > SubMaxAge {
+		return true
+	}
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sub subscribes evch, ErrTooManySubscribers means the channel has
+// MaxSubscribers already. evch belongs to the channel till UnSub, closing it
+// before gets the client dropped.
+func (c *Channel) Sub(evch chan *ChannelEvent) error {
+	return c.sub(evch, newSubscriber(nil))
+}
+
+// SubAs is Sub, with the client known as identity in Presence.
+func (c *Channel) SubAs(evch chan *ChannelEvent, identity string) error {
+	return c.sub(evch, SubOptions{Identity: identity}.subscriber(nil))
+}
+
+// Presence returns the distinct identities of clients subscribed right now,
+// sorted. Anonymous clients are not in it. Long polling clients are only
+// subscribed while they wait, so they drop out between messages.
+func (c *Channel) Presence() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, sub := range c.Clients {
+		if sub.identity != "" && !seen[sub.identity] {
+			seen[sub.identity] = true
+			ids = append(ids, sub.identity)
 		}
 	}
-	return false, 0
+	sort.Strings(ids)
+	return ids
 }
 
-func (c *Channel) Sub(evch chan *ChannelEvent) {
+// SubContext is Sub, but evch is unsubscribed as soon as ctx is done, and
+// Pub stops sending to it right away.
+func (c *Channel) SubContext(ctx context.Context, evch chan *ChannelEvent) error {
+	sub := newSubscriber(ctx.Done())
+	if err := c.sub(evch, sub); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		// evch may have been subscribed again since
+		if c.Clients[evch] == sub {
+			c.delClient(evch)
+		}
+	}()
+	return nil
+}
+
+func (c *Channel) sub(evch chan *ChannelEvent, sub *Subscriber) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	return c.addClient(evch, sub)
+}
 
-	c.Clients[evch] = true
+// addClient is sub, with c.lock held.
+func (c *Channel) addClient(evch chan *ChannelEvent, sub *Subscriber) error {
+	_, again := c.Clients[evch]
+	if !again && c.MaxSubscribers != 0 &&
+		uint(len(c.Clients)) >= c.MaxSubscribers {
+		return ErrTooManySubscribers
+	}
+
+	nSubscribed.Add(1)
+	c.lastSub = time.Now()
+	channelUsed(c)
+	c.Clients[evch] = sub
+	atomic.StoreInt32(&c.nClients, int32(len(c.Clients)))
+	if !again && len(c.Clients) == 1 {
+		firstSubscriber(c)
+	}
+	if Log != nil {
+		Log.Debugf("sub %s, %d subscribers", c.Name, len(c.Clients))
+	}
+	return nil
 }
 
 func (c *Channel) UnSub(evch chan *ChannelEvent) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	delete(c.Clients, evch)
+	if Log != nil {
+		Log.Debugf("unsub %s", c.Name)
+	}
+
+	c.delClient(evch)
 }
 
-func (c *Channel) Json() ([]byte, error) {
+// Heartbeat sends a heartbeat event on evch every so often, till stop is
+// called, so clients can keep idle connections alive. Nothing is sent once
+// stop returns. Heartbeats are dropped if evch is not being read. Clients
+// stay subscribed, heartbeats do not go through any channel.
+func Heartbeat(evch chan *ChannelEvent, every time.Duration) (stop func()) {
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				select {
+				case evch <- &ChannelEvent{Heartbeat: true}:
+				default:
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// MultiSub looks for data newer than the given etag in each of the channels.
+// All channels that have some are put in the returned response. If none has
+// anything new, evch is subscribed to all of them instead, till ctx is done,
+// and caller must MultiUnSub the returned channels once done waiting. Only
+// messages matching opts.Filter count. If some channel does not take more
+// subscribers the response has Error set, and evch is not subscribed to
+// anything.
+func MultiSub(
+	ctx context.Context, channels map[string]int64, opts SubOptions,
+	evch chan *ChannelEvent,
+) (*SubResponse, []*Channel) {
+	resp := &SubResponse{Channels: make(map[string]*ChanResponse)}
+	subs := make([]*Channel, 0, len(channels))
+
+	for name, etag := range channels {
+		ch := GetChannel(name)
+		// nothing new the client wants means wait for more
+		cr, has := ch.PollOptions(etag, opts)
+		if has && (len(cr.Payload) != 0 || cr.Lost) {
+			resp.Channels[ch.Name] = cr
+		} else {
+			subs = append(subs, ch)
+		}
+	}
+
+	if len(resp.Channels) != 0 {
+		return resp, nil
+	}
+
+	// something may have come since, so look again, under the same lock
+	// as subscribing this time
+	for i, ch := range subs {
+		sub := opts.subscriber(ctx.Done())
+		cr, err := ch.pollOrSub(channels[ch.Name], opts, evch, sub)
+		if err == nil && cr == nil {
+			continue
+		}
+		MultiUnSub(subs[:i], evch)
+		if err != nil {
+			resp.Error = ch.Name + ": " + err.Error()
+		} else {
+			resp.Channels[ch.Name] = cr
+		}
+		return resp, nil
+	}
+	return resp, subs
+}
+
+// pollOrSub is PollOptions, and if there is nothing the client wants, sub,
+// in one go so nothing published in between is missed. It returns nil if
+// it subscribed.
+func (c *Channel) pollOrSub(
+	etag int64, opts SubOptions, evch chan *ChannelEvent, sub *Subscriber,
+) (*ChanResponse, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	m, err := c.Messages.PeekNewest() // TODO handle error
-	if err == nil {
-		return json.MarshalIndent(
-			map[string]string{"etag": fmt.Sprintf("%d", m.Created)}, " ", "    ",
+	if c.reached(opts.MinEtag) {
+		cr, has := c.pollFilter(
+			etag, opts.Filter, opts.since(), opts.MaxBacklog,
 		)
-	} else {
+		if has && (len(cr.Payload) != 0 || cr.Lost) {
+			c.leaseTaken(cr, sub)
+			return cr, nil
+		}
+	}
+	sub.min, sub.from = opts.MinEtag, etag
+	return nil, c.addClient(evch, sub)
+}
+
+// SubStream subscribes evch to all channels for as long as ctx is not done,
+// without dropping it after each message. If a channel has to drop evch,
+// because it could not keep up, a value is sent on lagged (which should be
+// buffered), and the caller should catch up via Poll and subscribe again.
+// On error evch is not subscribed to anything.
+func SubStream(
+	ctx context.Context, names []string, opts SubOptions,
+	evch chan *ChannelEvent, lagged chan struct{},
+) ([]*Channel, error) {
+	subs := make([]*Channel, 0, len(names))
+	for _, name := range names {
+		ch := GetChannel(name)
+		sub := opts.subscriber(ctx.Done())
+		sub.stream = true
+		sub.lagged = lagged
+		if err := ch.sub(evch, sub); err != nil {
+			MultiUnSub(subs, evch)
+			return nil, errors.New(name + ": " + err.Error())
+		}
+		subs = append(subs, ch)
+	}
+	return subs, nil
+}
+
+// SubFrom is SubStream on c, together with the messages after etag, taken
+// under the same lock as subscribing, so none published in between is
+// missed or sent twice: evch only gets messages newer than the response.
+// opts.MaxBacklog is ignored, the whole backlog is returned. On error evch
+// is not subscribed.
+func (c *Channel) SubFrom(
+	ctx context.Context, etag int64, opts SubOptions,
+	evch chan *ChannelEvent, lagged chan struct{},
+) (*ChanResponse, error) {
+	sub := opts.subscriber(ctx.Done())
+	sub.stream = true
+	sub.lagged = lagged
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.addClient(evch, sub); err != nil {
+		return nil, err
+	}
+	cr, has := c.pollFilter(etag, opts.Filter, opts.since(), 0)
+	if !has {
+		cr = &ChanResponse{
+			Etag: fmt.Sprintf("%d", etag), Payload: []string{},
+			Encoding: c.encoding(),
+		}
+	}
+	return cr, nil
+}
+
+// MultiUnSub removes evch from all channels returned by MultiSub.
+func MultiUnSub(subs []*Channel, evch chan *ChannelEvent) {
+	for _, ch := range subs {
+		ch.UnSub(evch)
+	}
+}
+
+// Json returns the newest etag of the channel, "0" if it has no messages
+// (or was never created).
+func (c *Channel) Json() ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.Messages == nil {
 		return ETag0, nil
 	}
+	m, err := c.Messages.PeekNewest()
+	if err != nil || m == nil {
+		return ETag0, nil
+	}
+	return json.MarshalIndent(
+		map[string]string{"etag": fmt.Sprintf("%d", m.Created)}, " ", "    ",
+	)
+}
+
+// Clear drops all messages from the channel, both from memory and from the
+// persisted store. Clients stay subscribed.
+func (c *Channel) Clear() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.inited {
+		return ErrChannelNotFound
+	}
+
+	c.Messages.Empty()
+	c.Messages = NewCircularMessageArray(c.Size)
+	c.emptyUrgent()
+	c.stopCoalescing()
+	c.roomFreed()
+	EmptyChannel(c)
+	walLog(c, walClear, c.lastEtag)
+	return nil
+}
+
+// SetSize changes how many messages the channel keeps. When shrinking the
+// oldest messages are dropped.
+func (c *Channel) SetSize(size uint) error {
+	if size == 0 || (c.Latest && size != 1) {
+		return ErrBadSize
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.inited {
+		return ErrChannelNotFound
+	}
+	if size == c.Size {
+		return nil
+	}
+
+	for _, old := range c.Messages.Resize(size) {
+		Persist(c, nil, old)
+	}
+	c.Size = size
+	c.roomFreed()
+	return nil
+}
+
+// SetOptions changes the options of a channel, dropping the oldest messages
+// if it shrinks, as SetSize does, and restarting its expiry for the new life.
+func (c *Channel) SetOptions(opts ChannelOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	opts, err := namespaced(c.Name, opts)
+	if err != nil {
+		return err
+	}
+	opts = opts.normalized()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.inited {
+		return ErrChannelNotFound
+	}
+	if opts.Size != c.Size {
+		for _, old := range c.Messages.Resize(opts.Size) {
+			Persist(c, nil, old)
+		}
+	}
+	if opts.Life != c.Life {
+		if c.reaper != nil {
+			c.reaper.Stop()
+			c.reaper = nil
+		}
+		if opts.Life != 0 {
+			c.reaper = time.AfterFunc(opts.Life, c.expire)
+		}
+	}
+	c.ChannelOptions = opts
+	c.roomFreed()
+	infof(
+		"channel options changed: %s size=%d life=%s one2one=%v",
+		c.Name, opts.Size, opts.Life, opts.One2One,
+	)
+	return nil
+}
+
+// DeleteChannel removes the channel and its messages, and kicks out all
+// clients waiting on it.
+func DeleteChannel(name string) {
+	s := shardOf(name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, ok := s.channels[name]; ok {
+		c.remove(s)
+	}
+}
+
+// deleteChannel is DeleteChannel for c, if it still is the channel of its
+// name, which it tells.
+func deleteChannel(c *Channel) bool {
+	s := shardOf(c.Name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.channels[c.Name] != c {
+		return false
+	}
+	c.remove(s)
+	return true
+}
+
+// remove does the deleting for DeleteChannel. Must be called with s, the
+// shard of c, locked.
+func (c *Channel) remove(s *channelShard) {
+	delete(s.channels, c.Name)
+	channelGone(c)
+	infof("channel deleted: %s", c.Name)
+	channelDeleted(c.Name)
+	walLog(c, walDelete, 0)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.deleted = true
+	c.stopLeases()
+	if c.reaper != nil {
+		c.reaper.Stop()
+	}
+	if c.inited {
+		c.Messages.Empty()
+		c.Messages = NewCircularMessageArray(c.Size)
+		c.emptyUrgent()
+		EmptyChannel(c)
+	}
+	c.stopCoalescing()
+	c.roomFreed()
+	c.kick()
 }
 
 func (c *Channel) Empty() {
 	c.Messages.Empty()
+	c.roomFreed()
 	EmptyChannel(c)
+	walLog(c, walClear, c.lastEtag)
+	c.checkDrained()
 }
 
 func (ch *Channel) Append(resp *SubResponse, ith uint) {
+	ch.AppendFilter(resp, ith, nil)
+}
+
+// AppendFilter is Append, leaving out messages that do not match filter.
+// The etag is still that of the newest message, so the client does not see
+// the ones left out again. One2one channels ignore the filter, Append takes
+// all their messages.
+func (ch *Channel) AppendFilter(resp *SubResponse, ith uint, filter Filter) {
+	if ch.One2One {
+		filter = nil
+	}
+
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
 
-	payload := []string{}
+	ch.expireOldMessages(Clock())
+	resp.Channels[ch.Name] = ch.appendFrom(ith, filter, 0, 0)
+}
+
+// appendFrom returns the messages from ith on, leaving out those created
+// before since, and stopping after max of them unless max is 0, with
+// c.lock held.
+func (ch *Channel) appendFrom(
+	ith uint, filter Filter, since int64, max uint,
+) *ChanResponse {
+	resp := &ChanResponse{Payload: []string{}, Encoding: ch.encoding()}
 	etag := int64(0)
-	ml := ch.Messages.Length()
-	for i := ith; i < ml; i++ {
-		ithm, _ := ch.Messages.Ith(i)
-		payload = append(payload, string(ithm.Data))
-		etag = ithm.Created
+	if ch.Messages == nil {
+		return &ChanResponse{Etag: "0", Payload: []string{}}
+	}
+	if ch.One2One {
+		max, since = 0, 0 // all of them are taken, none may be lost
 	}
-	resp.Channels[ch.Name] = &ChanResponse{fmt.Sprintf("%d", etag), payload}
+	ch.Messages.ForEach(ith, func(m *Message) bool {
+		if max != 0 && uint(len(resp.Payload)) == max {
+			resp.More = true
+			return false
+		}
+		if m.Created < since {
+			etag = m.Created
+			return true
+		}
+		if data := m.Payload(); filter.Match(data) {
+			resp.add(ch, m, data)
+			m.handed()
+		}
+		etag = m.Created
+		return true
+	})
 	if ch.One2One {
 		ch.Empty()
 	}
+	resp.Etag = fmt.Sprintf("%d", etag)
+	return resp
+}
+
+// Poll is HasNew followed by Append, in one go, so nothing published in
+// between is skipped. It never subscribes, false means the client is up to
+// date.
+func (c *Channel) Poll(etag int64) (*ChanResponse, bool) {
+	return c.PollFilter(etag, nil)
+}
+
+// PollFilter is Poll, leaving out messages that do not match filter, like
+// AppendFilter.
+func (c *Channel) PollFilter(etag int64, filter Filter) (*ChanResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.pollFilter(etag, filter, 0, 0)
+}
+
+// PollOptions is PollFilter with opts.Filter, also leaving out messages
+// older than opts.MaxAge, and sending at most opts.MaxBacklog, if set.
+func (c *Channel) PollOptions(
+	etag int64, opts SubOptions,
+) (*ChanResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastSub = time.Now() // clients that get messages right away subscribed too
+	channelUsed(c)
+	if !c.reached(opts.MinEtag) {
+		return nil, false
+	}
+	cr, has := c.pollFilter(etag, opts.Filter, opts.since(), opts.MaxBacklog)
+	c.leaseTaken(cr, opts.subscriber(nil))
+	return cr, has
+}
+
+// pollFilter is PollFilter, leaving out messages created before since, and
+// sending at most max, unless it is 0, with c.lock held.
+func (c *Channel) pollFilter(
+	etag int64, filter Filter, since int64, max uint,
+) (*ChanResponse, bool) {
+	if c.One2One {
+		filter = nil
+	}
+
+	c.expireOldMessages(Clock())
+
+	has, ith, lost := c.sinceEtag(etag)
+	urgent := c.urgentAfter(etag)
+	if !has && len(urgent) == 0 {
+		return nil, false
+	}
+
+	resp := &ChanResponse{Etag: "0", Payload: []string{}, Encoding: c.encoding()}
+	if has {
+		resp = c.appendFrom(ith, filter, since, max)
+	}
+	if resp.More {
+		// urgent messages after the last one sent come with the next ones
+		urgent = urgentBefore(urgent, resp.Etag)
+	}
+	c.prependUrgent(resp, urgent, filter, since)
+	resp.Lost = lost
+	return resp, true
+}
+
+// Recent returns up to the last n messages, with the newest etag, whatever
+// the client has seen already. It does not take messages from one2one
+// channels, nor count as handing them over for PubAwait.
+func (c *Channel) Recent(n uint) *ChanResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	resp := &ChanResponse{
+		Etag: "0", Payload: []string{}, Encoding: c.encoding(),
+	}
+	if c.Messages == nil {
+		return resp
+	}
+
+	c.expireOldMessages(Clock())
+
+	msgs := c.Messages.Snapshot()
+	if n < uint(len(msgs)) {
+		msgs = msgs[uint(len(msgs))-n:]
+	}
+	for _, m := range msgs {
+		resp.add(c, m, m.Payload())
+		resp.Etag = fmt.Sprintf("%d", m.Created)
+	}
+	return resp
+}
+
+// encode turns data into a json safe string, binary channels send base64.
+func (c *Channel) encode(data []byte) string {
+	if c.Binary {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+func (c *Channel) encoding() string {
+	if c.Binary {
+		return "base64"
+	}
+	return ""
+}
+
+// Subscribers returns how many clients are waiting on the channel.
+func (c *Channel) Subscribers() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.Clients)
+}
+
+// MessageCount returns how many messages the channel holds.
+func (c *Channel) MessageCount() uint {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.Messages == nil {
+		return 0
+	}
+	return c.Messages.Length()
+}
+
+type ChannelStats struct {
+	Name           string        `json:"name"`
+	Subscribers    int           `json:"subscribers"`
+	MaxSubscribers uint          `json:"max_subscribers"` // 0 for no limit
+	Messages       uint          `json:"messages"`
+	Bytes          uint          `json:"bytes"` // of all messages
+	Size           uint          `json:"size"`
+	Life           time.Duration `json:"life"`
+	Oldest         int64         `json:"oldest,string"` // etag
+	Newest         int64         `json:"newest,string"` // etag
+	One2One        bool          `json:"one2one"`
+	Sealed         bool          `json:"sealed,omitempty"`
+	WebhookFailed  int64         `json:"webhook_failed,omitempty"`
+	SendLatency    *LatencyStats `json:"send_latency,omitempty"`
+	FanoutTime     *LatencyStats `json:"fanout_time,omitempty"`
+	LastPub        *time.Time    `json:"last_pub,omitempty"`
+	LastSub        *time.Time    `json:"last_sub,omitempty"`
+	Evictions      uint64        `json:"evictions"`
+	HighWater      uint          `json:"high_water"`
+
+	numberEtags bool // see MarshalJSON
+}
+
+// MarshalJSON has etags as json numbers, as they were at first, if
+// numberEtags is set, javascript can not hold them exactly.
+func (st ChannelStats) MarshalJSON() ([]byte, error) {
+	type stats ChannelStats // without this method
+	if !st.numberEtags {
+		return json.Marshal(stats(st))
+	}
+	return json.Marshal(&struct {
+		stats
+		Oldest int64 `json:"oldest"`
+		Newest int64 `json:"newest"`
+	}{stats(st), st.Oldest, st.Newest})
+}
+
+func (c *Channel) Stats() *ChannelStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	st := &ChannelStats{
+		Name: c.Name, Subscribers: len(c.Clients), Size: c.Size, Life: c.Life,
+		One2One: c.One2One, MaxSubscribers: c.MaxSubscribers, Sealed: c.sealed,
+		WebhookFailed: atomic.LoadInt64(&c.hookFailed),
+		SendLatency:   c.sendLatency.stats(), FanoutTime: c.fanoutTime.stats(),
+		LastPub: timeOrNil(c.lastPub), LastSub: timeOrNil(c.lastSub),
+	}
+	if c.urgent != nil {
+		st.Messages, st.Bytes = c.urgent.Length(), c.urgent.Bytes()
+	}
+	if c.Messages != nil {
+		st.Messages += c.Messages.Length()
+		st.Bytes += c.Messages.Bytes()
+		st.Evictions, st.HighWater = c.Messages.Stats()
+		if m, err := c.Messages.PeekOldest(); err == nil && m != nil {
+			st.Oldest = m.Created
+		}
+		if m, err := c.Messages.PeekNewest(); err == nil && m != nil {
+			st.Newest = m.Created
+		}
+	}
+	return st
+}
+
+// timeOrNil is t, or nil if t is zero, for omitempty.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// StatsJson is Stats as json, for admin tools. Etags are strings, like
+// everywhere else, unless numberEtags.
+func (c *Channel) StatsJson(numberEtags bool) ([]byte, error) {
+	st := c.Stats()
+	st.numberEtags = numberEtags
+	return json.MarshalIndent(st, " ", "    ")
 }
 
 func stats() interface{} {
-	ChannelLock.Lock()
-	defer ChannelLock.Unlock()
+	chans := make(map[string]*ChannelStats)
+	nSubscribers := 0
+	nMessages := uint(0)
+	eachChannel(func(ch *Channel) {
+		st := ch.Stats()
+		chans[ch.Name] = st
+		nSubscribers += st.Subscribers
+		nMessages += st.Messages
+	})
+
+	s := counters()
+	s["nSubscribers"] = nSubscribers
+	s["nMessages"] = nMessages
+	s["channels"] = chans
+	return s
+}
 
+// counters is the part of stats that does not have to look at every
+// channel.
+func counters() map[string]interface{} {
 	return map[string]interface{}{
-		"nChans": len(Channels),
-		"uptime":       gutils.TimeSinceHuman(ServerStart),
-		"ServerStart":  ServerStart,
+		"nChans":          NumChannels(),
+		"nLiveChans":      LiveChannels(),
+		"maxChans":        MaxChannels,
+		"nChanEvicted":    nChanEvicted.Value(),
+		"nForwarded":      nForwarded.Value(),
+		"nRelayed":        nRelayed.Value(),
+		"nPublished":      nPublished.Value(),
+		"nSubscribed":     nSubscribed.Value(),
+		"nDelivered":      nDelivered.Value(),
+		"nDropped":        nDropped.Value(),
+		"nClosedSubs":     nClosedSubs.Value(),
+		"nReaped":         nReaped.Value(),
+		"nWebhookSent":    nWebhookSent.Value(),
+		"nWebhookFailed":  nWebhookFailed.Value(),
+		"nWebhookDropped": nWebhookDropped.Value(),
+		"nCoalesced":      nCoalesced.Value(),
+		"memUsed":         atomic.LoadInt64(&memUsed),
+		"memBudget":       MemBudget,
+		"uptime":          gutils.TimeSinceHuman(ServerStart),
+		"ServerStart":     ServerStart,
 	}
 }
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pubN publishes n messages to c and returns their etags.
+func pubN(t *testing.T, c *Channel, n int) []int64 {
+	t.Helper()
+	etags := make([]int64, n)
+	for i := range etags {
+		etag, err := c.Pub([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		etags[i] = etag
+	}
+	return etags
+}
+
+func TestHasNew(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	etags := pubN(t, c, 5)
+
+	cases := []struct {
+		name string
+		etag int64
+		has  bool
+		ith  uint
+	}{
+		{"newest", etags[4], false, 5},
+		{"oldest", etags[0], true, 1},
+		{"second newest", etags[3], true, 4},
+		{"between", etags[1] + 1, true, 2},
+		{"before oldest", etags[0] - 1, true, 0},
+	}
+	for _, tc := range cases {
+		has, ith, lost := c.HasNew(tc.etag)
+		if has != tc.has || (has && ith != tc.ith) {
+			t.Errorf(
+				"%s: HasNew = %v, %d, want %v, %d",
+				tc.name, has, ith, tc.has, tc.ith,
+			)
+		}
+		if lost && tc.etag >= etags[0] {
+			t.Errorf("%s: lost data", tc.name)
+		}
+	}
+}
+
+func TestHasNewEmpty(t *testing.T) {
+	zero := NewChannel(ChannelOptions{})
+	zero.Messages = NewCircularMessageArray(0)
+	channels := map[string]*Channel{
+		"fresh": NewChannel(ChannelOptions{Size: 10}),
+		"zero":  zero,
+	}
+	for name, c := range channels {
+		for _, etag := range []int64{0, 1, Clock()} {
+			if has, ith, lost := c.HasNew(etag); has || ith != 0 || lost {
+				t.Errorf(
+					"%s: HasNew(%d) = %v, %d, %v", name, etag, has, ith, lost,
+				)
+			}
+		}
+	}
+}
+
+// recv waits for an event on evch, failing t if none comes.
+func recv(t *testing.T, evch chan *ChannelEvent) *ChannelEvent {
+	t.Helper()
+	select {
+	case ev := <-evch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+// subscribed tells if evch is still a client of c.
+func subscribed(c *Channel, evch chan *ChannelEvent) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, ok := c.Clients[evch]
+	return ok
+}
+
+func TestPubKeepsOtherSubscribers(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		c := NewChannel(ChannelOptions{Size: 10})
+		first := make(chan *ChannelEvent, 1)
+		if err := c.Sub(first); err != nil {
+			t.Fatal(err)
+		}
+
+		second := make(chan *ChannelEvent, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := c.Sub(second); err != nil {
+				t.Error(err)
+			}
+		}()
+		pubN(t, c, 1)
+		<-done
+
+		if ev := recv(t, first); ev.Mesg == nil {
+			t.Fatal("first got no message")
+		}
+		if subscribed(c, first) {
+			t.Fatal("first still subscribed after its message")
+		}
+		select {
+		case <-second: // subscribed before the pub, and got it
+		default:
+			if !subscribed(c, second) {
+				t.Fatal("second dropped without a message")
+			}
+		}
+	}
+}
+
+func TestPubKeepsFilteredSubscribers(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	other := make(chan *ChannelEvent, 1)
+	sub := newSubscriber(nil)
+	sub.filter = func(data []byte) bool { return bytes.Equal(data, []byte("x")) }
+	if err := c.sub(other, sub); err != nil {
+		t.Fatal(err)
+	}
+
+	pubN(t, c, 1)
+	if !subscribed(c, other) {
+		t.Fatal("subscriber dropped for a message it does not want")
+	}
+	if _, err := c.Pub([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := recv(t, other); string(ev.Mesg.Data) != "x" {
+		t.Fatalf("got %q", ev.Mesg.Data)
+	}
+}
+
+func TestPubTooLarge(t *testing.T) {
+	for _, opts := range []ChannelOptions{
+		{Size: 10, MaxMsgBytes: 16},
+		{Size: 10, MaxBytes: 16},
+	} {
+		c := NewChannel(opts)
+		etags := pubN(t, c, 2)
+		before := c.Stats()
+
+		if _, err := c.Pub(bytes.Repeat([]byte("x"), 17)); err != ErrMsgTooLarge {
+			t.Fatalf("%+v: Pub = %v, want ErrMsgTooLarge", opts, err)
+		}
+		after := c.Stats()
+		if after.Messages != 2 || after.Bytes != before.Bytes ||
+			after.Newest != etags[1] {
+			t.Fatalf("%+v: buffer changed, %+v", opts, after)
+		}
+	}
+}
+
+func TestEtagsIncrease(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 1000})
+	etags := pubN(t, c, 1000)
+	for i := 1; i < len(etags); i++ {
+		if etags[i] <= etags[i-1] {
+			t.Fatalf("etag %d is %d, after %d", i, etags[i], etags[i-1])
+		}
+	}
+}
+
+func TestPollWhilePublishing(t *testing.T) {
+	const n = 5000
+	c := NewChannel(ChannelOptions{Size: n})
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := c.Pub([]byte(fmt.Sprint(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	got, etag := 0, int64(0)
+	for deadline := time.Now().Add(10 * time.Second); got < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d of %d", got, n)
+		}
+		cr, has := c.Poll(etag)
+		if !has {
+			continue
+		}
+		if cr.Lost {
+			t.Fatal("lost data")
+		}
+		for _, p := range cr.Payload {
+			if p != fmt.Sprint(got) {
+				t.Fatalf("got %s, want %d", p, got)
+			}
+			got++
+		}
+		next, err := strconv.ParseInt(cr.Etag, 10, 64)
+		if err != nil || next <= etag {
+			t.Fatalf("etag %s after %d", cr.Etag, etag)
+		}
+		etag = next
+	}
+}
+
+// jsonEtag is the etag c.Json says c has.
+func jsonEtag(t *testing.T, c *Channel) string {
+	t.Helper()
+	data, err := c.Json()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := map[string]string{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	return v["etag"]
+}
+
+func TestJsonNew(t *testing.T) {
+	c, err := GetOrCreateChannel("test/json", ChannelOptions{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteChannel(c.Name)
+
+	if etag := jsonEtag(t, c); etag != "0" {
+		t.Fatalf("etag of a new channel is %s", etag)
+	}
+	etags := pubN(t, c, 1)
+	if etag := jsonEtag(t, c); etag != fmt.Sprint(etags[0]) {
+		t.Fatalf("etag is %s, want %d", etag, etags[0])
+	}
+}
+
+func TestPubWithEtag(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	etag := Clock() + int64(time.Second)
+
+	if ok, err := c.PubWithEtag([]byte("a"), etag); !ok || err != nil {
+		t.Fatalf("first PubWithEtag = %v, %v", ok, err)
+	}
+	if ok, err := c.PubWithEtag([]byte("a"), etag); ok || err != nil {
+		t.Fatalf("retry = %v, %v, want false, nil", ok, err)
+	}
+	if _, err := c.PubWithEtag([]byte("b"), etag); err != ErrEtagConflict {
+		t.Fatalf("other data = %v, want ErrEtagConflict", err)
+	}
+	if _, err := c.PubWithEtag([]byte("c"), etag-1); err != ErrStaleEtag {
+		t.Fatalf("stale etag = %v, want ErrStaleEtag", err)
+	}
+	if n := c.Stats().Messages; n != 1 {
+		t.Fatalf("%d messages, want 1", n)
+	}
+}
+
+func TestEmptyChannel(t *testing.T) {
+	channels := map[string]*Channel{
+		"empty":         NewChannel(ChannelOptions{Size: 10}),
+		"never created": shellChannel("test/never"),
+	}
+	for name, c := range channels {
+		if has, _, _ := c.HasNew(0); has {
+			t.Errorf("%s: HasNew", name)
+		}
+		if etag := jsonEtag(t, c); etag != "0" {
+			t.Errorf("%s: Json etag %s", name, etag)
+		}
+
+		resp := &SubResponse{Channels: map[string]*ChanResponse{}}
+		c.Append(resp, 0)
+		if cr := resp.Channels[c.Name]; cr.Etag != "0" || len(cr.Payload) != 0 {
+			t.Errorf("%s: Append %+v", name, cr)
+		}
+		if cr := c.Recent(5); cr.Etag != "0" || len(cr.Payload) != 0 {
+			t.Errorf("%s: Recent %+v", name, cr)
+		}
+		if st := c.Stats(); st.Messages != 0 || st.Bytes != 0 ||
+			st.Oldest != 0 || st.Newest != 0 {
+			t.Errorf("%s: Stats %+v", name, st)
+		}
+	}
+}
+
+func TestCreateChannelMismatch(t *testing.T) {
+	name := "test/mismatch"
+	opts := ChannelOptions{Size: 10, Life: time.Minute}
+	if _, created, err := CreateChannel(name, opts); !created || err != nil {
+		t.Fatalf("CreateChannel = %v, %v", created, err)
+	}
+	defer DeleteChannel(name)
+
+	if _, created, err := CreateChannel(name, opts); created || err != nil {
+		t.Fatalf("same options: CreateChannel = %v, %v", created, err)
+	}
+	for _, other := range []ChannelOptions{
+		{Size: 1000, Life: time.Minute},
+		{Size: 10},
+		{Size: 10, Life: time.Minute, One2One: true},
+	} {
+		ch, created, err := CreateChannel(name, other)
+		if created || err != ErrChannelExists {
+			t.Fatalf("%+v: CreateChannel = %v, %v", other, created, err)
+		}
+		if ch.Stats().Size != 10 || ch.Stats().Life != time.Minute {
+			t.Fatalf("%+v: options changed to %+v", other, ch.Stats())
+		}
+	}
+	if _, err := GetOrCreateChannel(name, ChannelOptions{Size: 1000}); err != ErrChannelExists {
+		t.Fatalf("GetOrCreateChannel = %v", err)
+	}
+}
+
+// checkOrder checks the messages of one subscriber, "publisher:i", come in
+// etag order, each publisher's in the order it published them, none missing.
+func checkOrder(t *testing.T, who string, msgs []*Message, pubs, n int) {
+	t.Helper()
+	if len(msgs) != pubs*n {
+		t.Errorf("%s got %d messages, want %d", who, len(msgs), pubs*n)
+		return
+	}
+	next := make([]int, pubs)
+	for i, m := range msgs {
+		if i > 0 && m.Created <= msgs[i-1].Created {
+			t.Errorf("%s: etag %d after %d", who, m.Created, msgs[i-1].Created)
+			return
+		}
+		p, j := 0, 0
+		if _, err := fmt.Sscanf(string(m.Data), "%d:%d", &p, &j); err != nil {
+			t.Errorf("%s: %q", who, m.Data)
+			return
+		}
+		if j != next[p] {
+			t.Errorf("%s: got %d:%d, want %d:%d", who, p, j, p, next[p])
+			return
+		}
+		next[p]++
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	const pubs, n, streams, pollers = 4, 500, 4, 4
+	c := NewChannel(ChannelOptions{Size: pubs * n})
+
+	// stream subscribers get every message as it is published
+	wg := sync.WaitGroup{}
+	for s := 0; s < streams; s++ {
+		evch := make(chan *ChannelEvent, pubs*n)
+		sub := newSubscriber(nil)
+		sub.stream = true
+		if err := c.sub(evch, sub); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			msgs := []*Message{}
+			for len(msgs) < pubs*n {
+				select {
+				case ev := <-evch:
+					msgs = append(msgs, ev.Messages()...)
+				case <-time.After(5 * time.Second):
+					t.Errorf("stream %d timed out", s)
+					return
+				}
+			}
+			checkOrder(t, fmt.Sprint("stream ", s), msgs, pubs, n)
+		}(s)
+	}
+
+	// one shot subscribers come back with the etag of what they got
+	for p := 0; p < pollers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			msgs, etag := []*Message{}, int64(0)
+			for len(msgs) < pubs*n {
+				evch := make(chan *ChannelEvent, 1)
+				cr, err := c.pollOrSub(
+					etag, SubOptions{}, evch, newSubscriber(nil),
+				)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if cr == nil {
+					ev := recv(t, evch)
+					msgs = append(msgs, ev.Messages()...)
+					etag = ev.Mesg.Created
+					continue
+				}
+				if cr.Lost {
+					t.Errorf("poller %d lost data", p)
+					return
+				}
+				msgs = append(msgs, cr.msgs...)
+				etag, _ = strconv.ParseInt(cr.Etag, 10, 64)
+			}
+			checkOrder(t, fmt.Sprint("poller ", p), msgs, pubs, n)
+		}(p)
+	}
+
+	for p := 0; p < pubs; p++ {
+		go func(p int) {
+			for i := 0; i < n; i++ {
+				if _, err := c.Pub([]byte(fmt.Sprintf("%d:%d", p, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+func TestNewChannelIsDetached(t *testing.T) {
+	a, b := NewChannel(ChannelOptions{Size: 10}), NewChannel(ChannelOptions{Size: 10})
+	pubN(t, a, 3)
+	if n := b.Stats().Messages; n != 0 {
+		t.Fatalf("other channel has %d messages", n)
+	}
+	if len(ListChannels()) != 0 || ChannelExists("") {
+		t.Fatalf("detached channels are listed: %v", ListChannels())
+	}
+}
+
+func TestResetChannels(t *testing.T) {
+	c, err := GetOrCreateChannel("test/reset", ChannelOptions{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubN(t, c, 1)
+	evch := make(chan *ChannelEvent, 1)
+	if err := c.Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+	detached := NewChannel(ChannelOptions{Size: 10})
+	pubN(t, detached, 1)
+
+	ResetChannels()
+	if ev := recv(t, evch); ev.Mesg != nil {
+		t.Fatalf("subscriber got %q, not kicked", ev.Mesg.Data)
+	}
+	if ChannelExists("test/reset") || len(ListChannels()) != 0 {
+		t.Fatalf("channels left: %v", ListChannels())
+	}
+	if n := detached.Stats().Messages; n != 1 {
+		t.Fatalf("detached channel has %d messages", n)
+	}
+
+	c, err = GetOrCreateChannel("test/reset", ChannelOptions{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteChannel(c.Name)
+	if n := c.Stats().Messages; n != 0 {
+		t.Fatalf("new channel has %d messages", n)
+	}
+}
+
+func TestSubFromWhilePublishing(t *testing.T) {
+	const n = 2000
+	for try := 0; try < 10; try++ {
+		c := NewChannel(ChannelOptions{Size: n})
+		published := make(chan struct{}, n)
+		go func() {
+			for i := 0; i < n; i++ {
+				if _, err := c.Pub([]byte(fmt.Sprintf("0:%d", i))); err != nil {
+					t.Error(err)
+					return
+				}
+				published <- struct{}{}
+			}
+		}()
+		for i := 0; i < try*n/10; i++ {
+			<-published // subscribe at various points
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		evch, lagged := make(chan *ChannelEvent, n), make(chan struct{}, 1)
+		cr, err := c.SubFrom(ctx, 0, SubOptions{}, evch, lagged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs := append([]*Message{}, cr.msgs...)
+		for len(msgs) < n {
+			select {
+			case ev := <-evch:
+				msgs = append(msgs, ev.Messages()...)
+			case <-lagged:
+				t.Fatal("lagged")
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %d of %d", len(msgs), n)
+			}
+		}
+		checkOrder(t, fmt.Sprint("try ", try), msgs, 1, n)
+		cancel()
+	}
+}
+
+func TestOddEtags(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	etags := pubN(t, c, 3)
+
+	for _, etag := range []int64{-1, -etags[2]} {
+		if has, ith, lost := c.HasNew(etag); !has || ith != 0 || lost {
+			t.Errorf("HasNew(%d) = %v, %d, %v", etag, has, ith, lost)
+		}
+	}
+
+	// a client from the future is caught up, and gets what comes next
+	future := etags[2] + int64(time.Hour)
+	if has, _, _ := c.HasNew(future); has {
+		t.Fatal("HasNew of a future etag")
+	}
+	evch := make(chan *ChannelEvent, 1)
+	cr, err := c.pollOrSub(future, SubOptions{}, evch, newSubscriber(nil))
+	if err != nil || cr != nil {
+		t.Fatalf("pollOrSub = %+v, %v", cr, err)
+	}
+	next := pubN(t, c, 1)
+	if ev := recv(t, evch); ev.Mesg == nil || ev.Mesg.Created != next[0] {
+		t.Fatalf("got %+v, want %d", ev.Mesg, next[0])
+	}
+	if has, ith, _ := c.HasNew(etags[2]); !has || ith != 3 {
+		t.Fatalf("HasNew after the future etag = %v, %d", has, ith)
+	}
+}
+
+func TestClosedSubscriber(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	closed := make(chan *ChannelEvent, 1)
+	sub := newSubscriber(nil)
+	sub.stream = true
+	sub.lagged = make(chan struct{}, 1)
+	if err := c.sub(closed, sub); err != nil {
+		t.Fatal(err)
+	}
+	other := make(chan *ChannelEvent, 1)
+	if err := c.Sub(other); err != nil {
+		t.Fatal(err)
+	}
+	before := nClosedSubs.Value()
+
+	close(closed)
+	pubN(t, c, 1)
+	recv(t, other)
+	for deadline := time.Now().Add(time.Second); subscribed(c, closed); {
+		if time.Now().After(deadline) {
+			t.Fatal("closed subscriber not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := nClosedSubs.Value(); n != before+1 {
+		t.Fatalf("nClosedSubs went from %d to %d", before, n)
+	}
+	if _, err := c.Pub([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReapKicks(t *testing.T) {
+	defer func(age time.Duration) { SubMaxAge = age }(SubMaxAge)
+	SubMaxAge = time.Millisecond
+
+	c, err := GetOrCreateChannel("test/reap", ChannelOptions{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteChannel(c.Name)
+	evch := make(chan *ChannelEvent, 1)
+	if err := c.Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	ReapSubscribers()
+	if ev := recv(t, evch); ev.Mesg != nil || !ev.Reaped {
+		t.Fatalf("reaped subscriber got %+v", ev)
+	}
+	if subscribed(c, evch) {
+		t.Fatal("reaped subscriber still subscribed")
+	}
+}
+
+func TestStatsJsonEtags(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	etags := pubN(t, c, 2)
+	for _, number := range []bool{false, true} {
+		data, err := c.StatsJson(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := map[string]interface{}{}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]int64{
+			"oldest": etags[0], "newest": etags[1],
+		} {
+			got := fmt.Sprint(v[key])
+			_, isNumber := v[key].(json.Number)
+			if got != fmt.Sprint(want) || isNumber != number {
+				t.Errorf("number=%v: %s is %#v, want %d", number, key, v[key], want)
+			}
+		}
+		if v["name"] != "" || v["messages"] != json.Number("2") {
+			t.Errorf("number=%v: %s", number, data)
+		}
+	}
+}
+
+func TestCreateWhileReading(t *testing.T) {
+	defer ResetChannels()
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("test/%d", i)
+		c := GetChannel(name) // a shell till created
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := GetOrCreateChannel(name, ChannelOptions{Size: 10}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := c.Json(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPubWhileSetOptions(t *testing.T) {
+	defer ResetChannels()
+	c := mustCreate(t, "test/options")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			opts := ChannelOptions{Size: 10, MaxMsgBytes: uint(10 + i%2)}
+			if err := c.SetOptions(opts); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := c.Pub([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.PubPriority([]byte("hello"), 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.PubBatch([][]byte{[]byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestMaxAgeOne2One(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10, One2One: true})
+	pubN(t, c, 1)
+	time.Sleep(10 * time.Millisecond)
+
+	taken := 0
+	for _, opts := range []SubOptions{{MaxAge: time.Millisecond}, {}} {
+		if cr, has := c.PollOptions(0, opts); has {
+			taken += len(cr.Payload)
+		}
+	}
+	if taken != 1 {
+		t.Fatalf("took %d of 1 messages", taken)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import . "github.com/amitu/gutils"
+import (
+	"sync/atomic"
+
+	. "github.com/amitu/gutils"
+)
 
 func conv(v interface{}, err error) (*Message, error) {
 	if v == nil {
@@ -11,26 +15,68 @@ func conv(v interface{}, err error) (*Message, error) {
 
 type CircularMessageArray struct {
 	CircularArray
+	bytes     uint   // total len of Data of all messages
+	evictions uint64 // pushes that dropped the oldest message
+	highWater uint   // most messages held at once
 }
 
 func NewCircularMessageArray(size uint) *CircularMessageArray {
-	return &CircularMessageArray{CircularArray{Size: size}}
+	return &CircularMessageArray{CircularArray: CircularArray{Size: size}}
 }
 
 func (circ *CircularMessageArray) Push(buf *Message) (*Message, bool){
+	circ.account(len(buf.Data))
 	v, dropped := circ.CircularArray.Push(buf)
+	if n := circ.Length(); n > circ.highWater {
+		circ.highWater = n
+	}
 	if dropped {
-		return v.(*Message), true
+		circ.evictions++
+		old := v.(*Message)
+		circ.account(-len(old.Data))
+		return old, true
 	}
 	return nil, false
 }
 
+// Stats tells how many pushes dropped the oldest message to make room, and
+// the most messages the array has held at once, for sizing it. Many
+// evictions mean it is too small, a high water well below its size that it
+// is too large.
+func (circ *CircularMessageArray) Stats() (evictions uint64, highWater uint) {
+	return circ.evictions, circ.highWater
+}
+
 func (circ *CircularMessageArray) Pop() (*Message, error) {
-	return conv(circ.CircularArray.Pop())
+	return circ.took(conv(circ.CircularArray.Pop()))
 }
 
 func (circ *CircularMessageArray) PopNewest() (*Message, error) {
-	return conv(circ.CircularArray.PopNewest())
+	return circ.took(conv(circ.CircularArray.PopNewest()))
+}
+
+func (circ *CircularMessageArray) took(m *Message, err error) (*Message, error) {
+	if m != nil {
+		circ.account(-len(m.Data))
+	}
+	return m, err
+}
+
+func (circ *CircularMessageArray) Empty() {
+	circ.CircularArray.Empty()
+	circ.account(-int(circ.bytes))
+}
+
+// account keeps track of bytes held by this array, and by all arrays
+// together for the memory budget.
+func (circ *CircularMessageArray) account(n int) {
+	circ.bytes = uint(int(circ.bytes) + n)
+	atomic.AddInt64(&memUsed, int64(n))
+}
+
+// Bytes is the total size of all messages in the array.
+func (circ *CircularMessageArray) Bytes() uint {
+	return circ.bytes
 }
 
 func (circ *CircularMessageArray) PeekOldest() (*Message, error) {
@@ -44,3 +90,88 @@ func (circ *CircularMessageArray) PeekNewest() (*Message, error) {
 func (circ *CircularMessageArray) Ith(i uint) (*Message, error) {
 	return conv(circ.CircularArray.Ith(i))
 }
+
+// ForEach calls fn with each message from the ith on, oldest first, till fn
+// returns false.
+func (circ *CircularMessageArray) ForEach(from uint, fn func(*Message) bool) {
+	for i := from; i < circ.Length(); i++ {
+		m, err := circ.Ith(i)
+		if err != nil || !fn(m) {
+			return
+		}
+	}
+}
+
+// Snapshot returns all messages, oldest first, in a new slice.
+func (circ *CircularMessageArray) Snapshot() []*Message {
+	msgs := make([]*Message, 0, circ.Length())
+	circ.ForEach(0, func(m *Message) bool {
+		msgs = append(msgs, m)
+		return true
+	})
+	return msgs
+}
+
+// IndexAfter returns the index of the oldest message newer than etag, Length
+// if there is none.
+func (circ *CircularMessageArray) IndexAfter(etag int64) uint {
+	lo, hi := uint(0), circ.Length()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		m, err := circ.Ith(mid)
+		if err != nil {
+			return circ.Length()
+		}
+		if m.Created <= etag {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Resize changes the capacity of the array, keeping the newest messages that
+// fit. The dropped ones are returned, oldest first. Stats carry on, the
+// dropped ones are not evictions.
+func (circ *CircularMessageArray) Resize(size uint) []*Message {
+	dropped := []*Message{}
+	n := NewCircularMessageArray(size)
+	for _, m := range circ.Snapshot() {
+		if old, ok := n.Push(m); ok {
+			dropped = append(dropped, old)
+		}
+	}
+	n.evictions, n.highWater = circ.evictions, circ.highWater
+	circ.account(-int(circ.bytes))
+	*circ = *n
+	return dropped
+}
+
+// IndexOfEtag finds the message with Created == etag using binary search, as
+// messages are pushed in increasing order of Created. If more than one
+// message has the same etag, the oldest of them is returned.
+func (circ *CircularMessageArray) IndexOfEtag(etag int64) (uint, bool) {
+	lo, hi := uint(0), circ.Length()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		m, err := circ.Ith(mid)
+		if err != nil {
+			return 0, false
+		}
+		if m.Created < etag {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == circ.Length() {
+		return 0, false
+	}
+	m, err := circ.Ith(lo)
+	if err != nil {
+		return 0, false
+	}
+	return lo, m.Created == etag
+}
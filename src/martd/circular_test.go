@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+// snapshotEtags pushes n messages, etags 1 to n, to an array of size and
+// returns the etags of its Snapshot.
+func snapshotEtags(size uint, n int) []int64 {
+	circ := NewCircularMessageArray(size)
+	for i := 1; i <= n; i++ {
+		circ.Push(&Message{Created: int64(i)})
+	}
+	etags := []int64{}
+	for _, m := range circ.Snapshot() {
+		etags = append(etags, m.Created)
+	}
+	return etags
+}
+
+func TestSnapshot(t *testing.T) {
+	cases := []struct {
+		name string
+		size uint
+		n    int
+		want []int64
+	}{
+		{"empty", 5, 0, []int64{}},
+		{"partial", 5, 3, []int64{1, 2, 3}},
+		{"full", 5, 5, []int64{1, 2, 3, 4, 5}},
+		{"wrapped", 5, 7, []int64{3, 4, 5, 6, 7}},
+		{"wrapped twice", 3, 8, []int64{6, 7, 8}},
+	}
+	for _, tc := range cases {
+		got := snapshotEtags(tc.size, tc.n)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: Snapshot = %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: Snapshot = %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	circ := NewCircularMessageArray(3)
+	circ.Push(&Message{Created: 1})
+	snap := circ.Snapshot()
+	circ.Push(&Message{Created: 2})
+	snap[0] = nil
+	if len(snap) != 1 || circ.Length() != 2 {
+		t.Fatalf("snapshot %v, array holds %d", snap, circ.Length())
+	}
+	if m, err := circ.PeekOldest(); err != nil || m.Created != 1 {
+		t.Fatalf("PeekOldest = %v, %v", m, err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+	Etags are times, in unix nanoseconds, read from Clock, and messages
+	expire by them. Clock defaults to the wall clock at startup moved on by
+	the monotonic clock, so NTP stepping the wall clock back does not make
+	it go back. Whatever Clock says, etags of a channel still only ever go
+	up, see nextEtag. Set Clock before any channel is used, to a counter
+	say, for runs that have to be repeatable.
+*/
+
+var Clock = monotonicClock()
+
+func monotonicClock() func() int64 {
+	start := time.Now()
+	wall := start.UnixNano()
+	return func() int64 {
+		return wall + int64(time.Since(start))
+	}
+}
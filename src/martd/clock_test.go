@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClockGoingBack(t *testing.T) {
+	defer func(clock func() int64) { Clock = clock }(Clock)
+	now := int64(1e18)
+	Clock = func() int64 {
+		now -= 1000
+		return now
+	}
+
+	c := NewChannel(ChannelOptions{Size: 100})
+	etags := pubN(t, c, 100)
+	for i := 1; i < len(etags); i++ {
+		if etags[i] <= etags[i-1] {
+			t.Fatalf("etag %d is %d, after %d", i, etags[i], etags[i-1])
+		}
+	}
+	if has, ith, _ := c.HasNew(etags[49]); !has || ith != 50 {
+		t.Fatalf("HasNew = %v, %d, want true, 50", has, ith)
+	}
+}
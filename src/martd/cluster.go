@@ -0,0 +1,36 @@
+package main
+
+import "hash/fnv"
+
+/*
+	martd nodes do not share channels, so to run more than one, every
+	channel has to live on one of them, the same one for publishers and
+	subscribers. ChannelOwner picks it by rendezvous hashing: each node
+	gets a score, the 64 bit FNV-1a hash of the node, a zero byte and the
+	channel name, and the highest score wins, ties going to the node that
+	sorts first. It only depends on its arguments, so a proxy, a client, or
+	a node after a restart all pick the same owner, in any language. Adding
+	or removing a node only moves the channels that were, or will be, on
+	it.
+*/
+
+// ChannelOwner returns which of nodes channel name lives on, "" if there
+// are no nodes. The order of nodes does not matter.
+func ChannelOwner(name string, nodes []string) string {
+	owner, best := "", uint64(0)
+	for _, node := range nodes {
+		score := ownerScore(name, node)
+		if owner == "" || score > best || (score == best && node < owner) {
+			owner, best = node, score
+		}
+	}
+	return owner
+}
+
+func ownerScore(name, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return h.Sum64()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+/*
+	A channel with coalesce set sends at most one push per coalesce window
+	to its subscribers, for state that changes faster than anyone cares to
+	see, like a progress bar. A push after a quiet spell goes out right
+	away and opens a window. Pushes during the window are held, each one
+	replacing the one held before it, and when the window is over the last
+	of them is published, and a new window opens. Pushes that were replaced
+	never make it into the channel. Unlike latest, which is about what the
+	channel keeps, this is about how often subscribers are sent something.
+
+	Only Pub coalesces, PubWithID, PubPriority, PubBatch and the like go out
+	right away. The etag Pub returns for a held push is the one it gets once
+	published, unless other pushes went out in between, then it gets a newer
+	one. A push still held when the channel is sealed, deleted or expires
+	is dropped.
+*/
+
+var nCoalesced = expvar.NewInt("nCoalesced")
+
+// coalesce holds data if a coalesce window is open, and opens one if not.
+// held tells if it did hold data, then etag is the one it is meant to get.
+// Must be called with c.lock held.
+func (c *Channel) coalesce(data []byte) (etag int64, held bool, err error) {
+	if c.Messages == nil {
+		return 0, false, ErrChannelNotFound
+	}
+	if c.sealed {
+		return 0, false, ErrChannelSealed
+	}
+	if c.coalescer == nil {
+		c.coalescer = time.AfterFunc(c.Coalesce, c.flushCoalesced)
+		return 0, false, nil
+	}
+
+	if c.held != nil {
+		nCoalesced.Add(1)
+	}
+	c.held = &Message{Data: data, Created: c.nextEtag(Clock())}
+	return c.held.Created, true, nil
+}
+
+// flushCoalesced publishes the push held, if any, at the end of a coalesce
+// window, and starts the next window. With nothing held the window is
+// over.
+func (c *Channel) flushCoalesced() {
+	c.lock.Lock()
+	defer c.unlock()
+
+	m := c.held
+	if m == nil {
+		c.coalescer = nil
+		return
+	}
+	c.held = nil
+	c.coalescer.Reset(c.Coalesce)
+
+	etag := m.Created
+	if etag != c.lastEtag {
+		etag = 0 // others went out since, it needs a newer one
+	}
+	m, old, err := c.push(m.Data, etag, "", nil, false)
+	if err != nil {
+		warnf("could not publish coalesced push to %s: %s", c.Name, err)
+		return
+	}
+	if c.One2One {
+		c.pubOne(m, old) // SetOptions made it one2one since
+		return
+	}
+	Persist(c, m, old)
+	c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(m.Data)})
+}
+
+// stopCoalescing closes the coalesce window, dropping any push held.
+// Must be called with c.lock held.
+func (c *Channel) stopCoalescing() {
+	if c.coalescer != nil {
+		c.coalescer.Stop()
+	}
+	c.coalescer, c.held = nil, nil
+}
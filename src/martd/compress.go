@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/*
+	Channels created with compress=true keep their messages gzipped in
+	memory, trading cpu for memory. Clients, the db, the wal and snapshots
+	always see the original bytes, via Message.Payload. Messages smaller than
+	CompressMin are kept as is, gzip would not save anything on them, and
+	so are messages read back from disk at startup.
+
+	Responses to /sub and /recent are gzipped for clients that send
+	Accept-Encoding: gzip, unless they are smaller than CompressMin too.
+*/
+
+var (
+	CompressMin uint
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+)
+
+func init() {
+	flag.UintVar(
+		&CompressMin, "compress-min", 512,
+		"Smallest message or response, in bytes, that is gzipped.",
+	)
+}
+
+// Payload returns the data of the message, as published.
+func (m *Message) Payload() []byte {
+	if !m.gzipped {
+		return m.Data
+	}
+	r, err := gzip.NewReader(bytes.NewReader(m.Data))
+	if err != nil {
+		log.Println("Could not gunzip message:", err)
+		return nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Println("Could not gunzip message:", err)
+		return nil
+	}
+	return data
+}
+
+// compress gzips m.Data in place, if it is worth it. It must be done before
+// m is pushed, so memory accounting sees the compressed size.
+func (m *Message) compress() {
+	if m.gzipped || uint(len(m.Data)) < CompressMin {
+		return
+	}
+	var buf bytes.Buffer
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(&buf)
+	gz.Write(m.Data)
+	if err := gz.Close(); err != nil || buf.Len() >= len(m.Data) {
+		return
+	}
+	m.Data, m.gzipped = buf.Bytes(), true
+}
+
+// plain returns m as published, data being what was published, so fan out
+// does not have to gunzip it again for every client.
+func (m *Message) plain(data []byte) *Message {
+	if !m.gzipped {
+		return m
+	}
+	return &Message{
+		Data: data, Created: m.Created, ID: m.ID, Headers: m.Headers,
+		await: m.await,
+	}
+}
+
+// acceptsGzip tells if the client takes gzipped responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		return len(parts) < 2 || strings.TrimSpace(parts[1]) != "q=0"
+	}
+	return false
+}
+
+// writeBody writes j, gzipped if gz and j is big enough for it to help.
+func writeBody(w http.ResponseWriter, j []byte, gz bool) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !gz || uint(len(j)) < CompressMin {
+		w.Write(j)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(w)
+	zw.Write(j)
+	if err := zw.Close(); err != nil {
+		log.Println("Could not gzip response:", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+	Browsers only let pages of other origins call martd if it says so. With
+	no -cors-origins, the default, it says nothing, and only pages served
+	by martd itself, or behind the same proxy, can push and subscribe. With
+	-cors-origins every handler answers the origins listed, or all with *,
+	and preflight OPTIONS requests from them are answered right away with
+	-cors-methods and -cors-headers. Preflights from other origins are
+	refused. -origin is the older, single origin form of -cors-origins.
+
+	WebSockets are not subject to CORS, browsers open them to any origin.
+*/
+
+const corsMaxAge = "600" // seconds browsers may cache a preflight answer
+
+var (
+	CORSOrigins string
+	CORSMethods string
+	CORSHeaders string
+	origin      string
+	corsOrigins = make(map[string]bool)
+)
+
+func init() {
+	flag.StringVar(
+		&CORSOrigins, "cors-origins", "",
+		"Comma separated origins browsers may call from, * for any.",
+	)
+	flag.StringVar(
+		&CORSMethods, "cors-methods", "GET, POST, DELETE, OPTIONS",
+		"Methods other origins may use.",
+	)
+	flag.StringVar(
+		&CORSHeaders, "cors-headers", "Content-Type, Last-Event-ID",
+		"Request headers other origins may send.",
+	)
+	flag.StringVar(
+		&origin, "origin", "",
+		"Access-Control-Allow-Origin (use * for debugging), see -cors-origins.",
+	)
+}
+
+// SetupCORS reads -cors-origins and -origin.
+func SetupCORS() error {
+	for _, o := range strings.Split(CORSOrigins+","+origin, ",") {
+		o = strings.TrimSuffix(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+				return errors.New("invalid origin: " + o)
+			}
+		}
+		corsOrigins[o] = true
+	}
+	return nil
+}
+
+// allowedOrigin returns what Access-Control-Allow-Origin should be for a
+// request from o, "" if it is not allowed.
+func allowedOrigin(o string) string {
+	if corsOrigins["*"] {
+		return "*"
+	}
+	if corsOrigins[o] {
+		return o
+	}
+	return ""
+}
+
+// CORS adds the CORS headers for the origin of the request to what h
+// answers, and answers preflights itself.
+func CORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o := r.Header.Get("Origin")
+		if len(corsOrigins) == 0 || o == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := allowedOrigin(o)
+		preflight := r.Method == "OPTIONS" &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			if allowed == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Set("Access-Control-Allow-Methods", CORSMethods)
+			w.Header().Set("Access-Control-Allow-Headers", CORSHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
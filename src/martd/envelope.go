@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+/*
+	/sub and /recent can answer in a few shapes, picked with format: the
+	default {"channels": {...}}, ndjson, see ndjson.go, and items, for
+	frontends that page through one channel with a cursor:
+
+		{"cursor": "1234", "items": [{"etag": "1234", "data": "..."}]}
+
+	cursor is the etag to subscribe with next, items have what ndjson lines
+	have, and lost, drained and more are next to cursor when set. A
+	response can only have one cursor, so items takes exactly one channel,
+	and no patterns. Errors are {"error": "..."} whatever the format.
+*/
+
+type itemsEnvelope struct {
+	Cursor  string        `json:"cursor"`
+	Items   []*ndjsonLine `json:"items"`
+	Lost    bool          `json:"lost,omitempty"`
+	Drained bool          `json:"drained,omitempty"`
+	More    bool          `json:"more,omitempty"`
+	Count   int           `json:"count,omitempty"` // with count_only
+	Error   string        `json:"error,omitempty"`
+}
+
+// wantsItems tells if the client asked for the items envelope.
+func wantsItems(r *http.Request) bool {
+	return r.FormValue("format") == "items"
+}
+
+// envelope turns resp, of one channel at most, into an items envelope.
+func (resp *SubResponse) envelope() *itemsEnvelope {
+	if resp.Error != "" {
+		return &itemsEnvelope{Error: resp.Error}
+	}
+	env := &itemsEnvelope{Cursor: "0", Items: []*ndjsonLine{}}
+	for _, cr := range resp.Channels {
+		env.Cursor, env.Lost = cr.Etag, cr.Lost
+		env.Drained, env.More, env.Count = cr.Drained, cr.More, cr.Count
+	}
+	for _, l := range resp.lines() {
+		if l.Data != nil {
+			l.Channel = ""
+			env.Items = append(env.Items, l)
+		}
+	}
+	return env
+}
+
+// respondItems is respond, in the items envelope.
+func respondItems(w http.ResponseWriter, resp *SubResponse, gz bool) {
+	j, err := json.Marshal(resp.envelope())
+	if err != nil {
+		log.Println("Error during json.Marshal", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, j, gz)
+}
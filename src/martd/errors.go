@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+)
+
+// Errors returned by channels, compare with == or errors.Is.
+var (
+	ErrBadKey             = errors.New("invalid key")
+	ErrBadSize            = errors.New("size must be more than 0")
+	ErrMsgTooLarge        = errors.New("message too large")
+	ErrBadChannelName     = errors.New("invalid channel name")
+	ErrWrongClient        = errors.New("message is leased to another client")
+	ErrChannelNotFound    = errors.New("channel not found")
+	ErrChannelFull        = errors.New("channel is full")
+	ErrMemoryFull         = errors.New("server memory budget is full")
+	ErrStaleEtag          = errors.New("etag is not newer than the channel's")
+	ErrEtagConflict       = errors.New("etag already used for another message")
+	ErrInvalidPayload     = errors.New("payload is not valid json")
+	ErrRateLimited        = errors.New("channel publish rate exceeded")
+	ErrShuttingDown       = errors.New("server is shutting down")
+	ErrTooManySubscribers = errors.New("channel has too many subscribers")
+	ErrChannelExists      = errors.New("channel exists with other options")
+	ErrChannelSealed      = errors.New("channel is sealed")
+	ErrBadWebhook         = errors.New("webhook must be an http(s) url")
+	ErrAwaitTimeout       = errors.New("timed out waiting for delivery")
+	ErrTooManyChannels    = errors.New("server has too many channels")
+	ErrBadAdminKey        = errors.New("invalid admin key")
+	ErrWebhookNotAllowed  = errors.New("webhook needs admin_key or -webhook-hosts")
+	ErrBadPattern         = errors.New("* and ** must be whole segments")
+	ErrTooManyStars       = errors.New("pattern has too many **")
+	ErrBadFull            = errors.New(
+		"full must be overwrite, or reject or block on one2one, not latest, channels",
+	)
+)
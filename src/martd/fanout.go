@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Publishing does not send to subscribers, nor wait for anyone who does.
+	fanout only notes who gets what, and takes one shot subscribers off the
+	channel right away, as they are done with it either way. unlock puts
+	that on the channel's outbox, lets go of c.lock and returns. A sender
+	goroutine, one per channel, started when the outbox gets something and
+	gone once it is empty, does the sending, spread over up to
+	-fanout-workers goroutines on channels with many subscribers, so a few
+	slow clients do not hold up the rest. Neither publishers nor
+	subscribers and pollers waiting for the lock wait on slow clients.
+
+	The sender sends what is queued in order, one fanout at a time, so
+	stream subscribers see messages in the order they were published, and
+	kicks, drains and shutdowns, queued the same way, go out after the last
+	fanout. Stream subscribers that could not keep up are dropped once
+	sending is done. One shot subscribers look for new messages and
+	subscribe under one lock, see pollOrSub, so nothing published in
+	between goes missing.
+*/
+
+var FanoutWorkers int
+
+// channels with fewer subscribers are sent to by the publisher alone
+const fanoutParallelMin = 64
+
+func init() {
+	flag.IntVar(
+		&FanoutWorkers, "fanout-workers", 16,
+		"Most goroutines sending a message to subscribers of a channel.",
+	)
+}
+
+type delivery struct {
+	evch chan *ChannelEvent
+	sub  *Subscriber
+	ev   *ChannelEvent
+	ok   bool
+}
+
+// fanout has unlock send ev to all clients that want it. Must be called
+// with c.lock held, and released with unlock.
+func (c *Channel) fanout(ev *ChannelEvent) {
+	// subscriptions are one shot, so every client we deliver to is dropped,
+	// it will come back with the new etag. Stream subscribers stay till
+	// they fall behind.
+	batch := make([]delivery, 0, len(c.Clients))
+	for evch, sub := range c.Clients {
+		ev := c.minEtagEvent(ev, sub)
+		if ev != nil {
+			ev = c.relayedEvent(ev, sub)
+		}
+		if ev != nil {
+			ev = filterEvent(ev, sub.filter)
+		}
+		if ev == nil {
+			continue
+		}
+		if !sub.stream {
+			c.delClient(evch)
+		}
+		batch = append(batch, delivery{evch: evch, sub: sub, ev: ev})
+	}
+	if len(batch) != 0 {
+		c.pending = append(c.pending, batch)
+	}
+}
+
+// unlock releases c.lock, having queued whatever fanout noted for the
+// sender.
+func (c *Channel) unlock() {
+	for _, batch := range c.pending {
+		c.queue(batch)
+	}
+	c.pending = nil
+	c.lock.Unlock()
+}
+
+// queue has the sender send batch, after all queued before it, starting
+// the sender if it is not running. Must be called with c.lock held.
+func (c *Channel) queue(batch []delivery) {
+	if len(batch) == 0 {
+		return
+	}
+	c.outbox = append(c.outbox, batch)
+	if !c.sending {
+		c.sending = true
+		go c.sendOutbox()
+	}
+}
+
+// sendOutbox sends the batches queued on c, in order, till there are none
+// left. It holds c.lock only to take them off the outbox, and to drop the
+// subscribers that could not keep up.
+func (c *Channel) sendOutbox() {
+	for {
+		c.lock.Lock()
+		outbox := c.outbox
+		c.outbox = nil
+		if len(outbox) == 0 {
+			c.sending = false
+			c.lock.Unlock()
+			return
+		}
+		c.lock.Unlock()
+
+		// a client that failed is not waited on again for the next batches
+		failed := []delivery{}
+		dropped := map[*Subscriber]bool{}
+		for _, batch := range outbox {
+			live := batch[:0]
+			for _, d := range batch {
+				if !dropped[d.sub] {
+					live = append(live, d)
+				}
+			}
+			if len(live) == 0 {
+				continue
+			}
+			start := time.Now()
+			for _, d := range c.sendAll(live) {
+				dropped[d.sub] = true
+				failed = append(failed, d)
+			}
+			c.fanoutTime.record(int64(time.Since(start)))
+		}
+		if len(failed) == 0 {
+			continue
+		}
+		c.lock.Lock()
+		for _, d := range failed {
+			if c.Clients[d.evch] == d.sub {
+				c.delClient(d.evch)
+			}
+			d.sub.lag()
+		}
+		c.lock.Unlock()
+	}
+}
+
+// queueAll queues ev for every client, and drops them all, for telling
+// them the channel is gone or the like. Must be called with c.lock held.
+func (c *Channel) queueAll(ev *ChannelEvent) {
+	batch := make([]delivery, 0, len(c.Clients))
+	for evch, sub := range c.Clients {
+		batch = append(batch, delivery{evch: evch, sub: sub, ev: ev})
+		c.delClient(evch)
+	}
+	c.queue(batch)
+}
+
+// sendAll sends each delivery in batch, and returns those that failed.
+func (c *Channel) sendAll(batch []delivery) []delivery {
+	workers := FanoutWorkers
+	if len(batch) < fanoutParallelMin || workers < 1 {
+		workers = 1
+	}
+	if workers > len(batch) {
+		workers = len(batch)
+	}
+
+	next := int64(-1)
+	wg := sync.WaitGroup{}
+	work := func() {
+		defer wg.Done()
+		took := latency{}
+		defer c.sendLatency.merge(&took)
+		for {
+			i := atomic.AddInt64(&next, 1)
+			if i >= int64(len(batch)) {
+				return
+			}
+			d := &batch[i]
+			d.ok = c.send(d.evch, d.sub, d.ev)
+			if d.ok && d.ev.Mesg != nil {
+				took.add(Clock() - d.ev.Mesg.Created)
+			}
+		}
+	}
+	wg.Add(workers)
+	for i := 1; i < workers; i++ {
+		go work()
+	}
+	work()
+	wg.Wait()
+
+	failed := []delivery{}
+	for _, d := range batch {
+		if !d.ok {
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamSub subscribes a stream subscriber to c, with room for buffer
+// events.
+func streamSub(t *testing.T, c *Channel, buffer int) (chan *ChannelEvent, chan struct{}) {
+	t.Helper()
+	evch, lagged := make(chan *ChannelEvent, buffer), make(chan struct{}, 1)
+	sub := newSubscriber(nil)
+	sub.stream = true
+	sub.lagged = lagged
+	if err := c.sub(evch, sub); err != nil {
+		t.Fatal(err)
+	}
+	return evch, lagged
+}
+
+func TestFanoutParallel(t *testing.T) {
+	const pubs, n, streams = 4, 100, 2 * fanoutParallelMin
+	c := NewChannel(ChannelOptions{Size: pubs * n})
+	c.SendTimeout = 10 * time.Millisecond
+
+	// never reads, so it is dropped, without holding up the rest
+	_, stuck := streamSub(t, c, 0)
+
+	wg := sync.WaitGroup{}
+	for s := 0; s < streams; s++ {
+		evch, lagged := streamSub(t, c, pubs*n)
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			msgs := []*Message{}
+			for len(msgs) < pubs*n {
+				select {
+				case ev := <-evch:
+					msgs = append(msgs, ev.Messages()...)
+				case <-lagged:
+					t.Errorf("stream %d lagged", s)
+					return
+				case <-time.After(5 * time.Second):
+					t.Errorf("stream %d timed out", s)
+					return
+				}
+			}
+			checkOrder(t, fmt.Sprint("stream ", s), msgs, pubs, n)
+		}(s)
+	}
+
+	for p := 0; p < pubs; p++ {
+		go func(p int) {
+			for i := 0; i < n; i++ {
+				if _, err := c.Pub([]byte(fmt.Sprintf("%d:%d", p, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	select {
+	case <-stuck:
+	case <-time.After(time.Second):
+		t.Fatal("stuck subscriber was not dropped")
+	}
+	if st := c.Stats(); st.Subscribers != streams {
+		t.Fatalf("%d subscribers left, want %d", st.Subscribers, streams)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Filter decides which messages a subscriber wants. A nil Filter matches
+// everything. Filters run inside the fan out loop, with the channel locked,
+// so they must be cheap.
+type Filter func(data []byte) bool
+
+func (f Filter) Match(data []byte) bool {
+	return f == nil || f(data)
+}
+
+// PrefixFilter matches messages starting with prefix.
+func PrefixFilter(prefix []byte) Filter {
+	return func(data []byte) bool {
+		return bytes.HasPrefix(data, prefix)
+	}
+}
+
+// FieldFilter matches json object messages whose top level field is value.
+// String fields are compared as is, anything else by its json text, so
+// "count:3" and "ok:true" work too.
+func FieldFilter(field, value string) Filter {
+	return func(data []byte) bool {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return false
+		}
+		raw, ok := obj[field]
+		if !ok {
+			return false
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s == value
+		}
+		return string(raw) == value
+	}
+}
+
+// AllFilter matches messages that match all of filters.
+func AllFilter(filters ...Filter) Filter {
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	}
+	return func(data []byte) bool {
+		for _, f := range filters {
+			if !f(data) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// parseFilter builds the filter for a subscribe request, from prefix, and
+// where as "field:value". Both are optional.
+func parseFilter(prefix, where string) (Filter, error) {
+	filters := []Filter{}
+	if prefix != "" {
+		filters = append(filters, PrefixFilter([]byte(prefix)))
+	}
+	if where != "" {
+		i := strings.Index(where, ":")
+		if i <= 0 {
+			return nil, errors.New("invalid where, want field:value: " + where)
+		}
+		filters = append(filters, FieldFilter(where[:i], where[i+1:]))
+	}
+	return AllFilter(filters...), nil
+}
+
+// filterEvent returns the part of ev that f matches, nil if none of it.
+// Events without messages, like kicks, always match.
+func filterEvent(ev *ChannelEvent, f Filter) *ChannelEvent {
+	if f == nil || ev.Mesg == nil {
+		return ev
+	}
+	if ev.Batch == nil {
+		if f(ev.Mesg.Payload()) {
+			return ev
+		}
+		return nil
+	}
+
+	batch := []*Message{}
+	for _, m := range ev.Batch {
+		if f(m.Payload()) {
+			batch = append(batch, m)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return &ChannelEvent{Chan: ev.Chan, Mesg: batch[len(batch)-1], Batch: batch}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+/*
+	An html form can push straight to /pub. With multipart/form-data, as
+	forms with a file input are sent, the payload is the data field, a file
+	or a plain one, or else the only file of the form. With
+	application/x-www-form-urlencoded the payload is the data field. The
+	other fields of the form are read like the query, so channel, key and
+	the channel attributes can be inputs too. curl -d sends raw bodies as
+	urlencoded forms, so a body of that type with no data field is taken
+	as is, like any other body. A multipart form with neither is refused.
+*/
+
+// formMemory is how much of a multipart form is kept in memory, the rest
+// goes to temporary files.
+const formMemory = 32 << 20
+
+var errNoDataField = errors.New("no data field")
+
+// pubBody returns the payload of a push, and if it came in a form.
+func pubBody(r *http.Request) (data []byte, form bool, err error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "multipart/form-data" {
+		return multipartBody(r)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || ct != "application/x-www-form-urlencoded" {
+		return body, false, err
+	}
+	if values, err := url.ParseQuery(string(body)); err != nil ||
+		values["data"] == nil {
+		return body, false, nil // raw body, sent by curl -d and the like
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := r.ParseForm(); err != nil {
+		return nil, false, err
+	}
+	return []byte(r.PostForm.Get("data")), true, nil
+}
+
+func multipartBody(r *http.Request) ([]byte, bool, error) {
+	if err := r.ParseMultipartForm(formMemory); err != nil {
+		return nil, false, err
+	}
+	f := r.MultipartForm
+	defer f.RemoveAll()
+
+	files := f.File["data"]
+	if files == nil && len(f.File) == 1 {
+		for _, fs := range f.File {
+			files = fs
+		}
+	}
+	if files == nil {
+		if v := f.Value["data"]; len(v) != 0 {
+			return []byte(v[0]), true, nil
+		}
+		return nil, true, errNoDataField
+	}
+
+	file, err := files[0].Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	return data, true, err
+}
+
+// formQuery is the query for passing a form push on with its payload as
+// the body, see forwardPub.
+func formQuery(r *http.Request) string {
+	q := url.Values{}
+	for k, v := range r.Form {
+		if k != "data" {
+			q[k] = v
+		}
+	}
+	return q.Encode()
+}
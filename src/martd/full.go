@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+/*
+	A full channel drops its oldest message to make room for a new one, which
+	for a work queue is a job lost without anyone knowing. Full picks what
+	happens instead: "overwrite", or "", is that, "reject" fails the push
+	with ErrChannelFull, "block" has it wait for room, for at most
+	-full-timeout, then fail with ErrChannelFull. A channel is full when its
+	messages, and those leased to clients and not acked yet, see ack.go, are
+	Size, or when the new message would take it over MaxBytes. A push that
+	waits lets go of the channel lock meanwhile, and is woken whenever
+	something leaves the channel. The priority lane always overwrites.
+
+	Only one2one channels can reject or block, as messages leave them when
+	clients take them. Those of other channels only go when they expire, so
+	one that filled up would take nothing for as long as its life.
+*/
+
+var FullTimeout time.Duration
+
+func init() {
+	flag.DurationVar(
+		&FullTimeout, "full-timeout", 5*time.Second,
+		"How long a push to a full channel with full=block waits for room.",
+	)
+}
+
+// validFull tells if full is a policy for full channels.
+func validFull(full string) bool {
+	return full == "" || full == "overwrite" || full == "reject" ||
+		full == "block"
+}
+
+// hasRoom tells if n more messages, of size bytes, fit without dropping
+// any. Must be called with c.lock held.
+func (c *Channel) hasRoom(n int, size uint) bool {
+	c.expireOldMessages(Clock())
+	used := int(c.Messages.Length()) + len(c.inflight)
+	if used+n > int(c.Size) {
+		return false
+	}
+	return c.MaxBytes == 0 || c.Messages.Bytes()+size <= c.MaxBytes
+}
+
+// roomFreed wakes pushes waiting for room, something left the channel.
+// Must be called with c.lock held.
+func (c *Channel) roomFreed() {
+	if c.roomCond != nil {
+		c.roomCond.Broadcast()
+	}
+}
+
+// waitRoom makes sure n more messages, of size bytes, fit in c, as Full
+// says. waited tells if it had to let go of c.lock to wait, then whatever
+// the caller checked before may have changed. Must be called with c.lock
+// held.
+func (c *Channel) waitRoom(n int, size uint) (waited bool, err error) {
+	if c.Full == "" || c.Full == "overwrite" || c.hasRoom(n, size) {
+		return false, nil
+	}
+	if c.Full != "block" || n > int(c.Size) {
+		return false, ErrChannelFull
+	}
+
+	if c.roomCond == nil {
+		c.roomCond = sync.NewCond(&c.lock)
+	}
+	timedOut := false
+	t := time.AfterFunc(FullTimeout, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		timedOut = true
+		c.roomCond.Broadcast()
+	})
+	defer t.Stop()
+
+	for {
+		c.roomCond.Wait()
+
+		if c.deleted {
+			return true, ErrChannelNotFound
+		}
+		if c.sealed {
+			return true, ErrChannelSealed
+		}
+		if c.hasRoom(n, size) {
+			return true, nil
+		}
+		if timedOut {
+			return true, ErrChannelFull
+		}
+	}
+}
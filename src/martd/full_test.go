@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// blockedPub publishes to c, which is full, in the background, Pub's error
+// goes to the channel it returns.
+func blockedPub(t *testing.T, c *Channel) chan error {
+	t.Helper()
+	errch := make(chan error, 1)
+	go func() {
+		_, err := c.Pub([]byte("blocked"))
+		errch <- err
+	}()
+	select {
+	case err := <-errch:
+		t.Fatalf("Pub did not block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return errch
+}
+
+func mustCreateFull(t *testing.T, name string) *Channel {
+	t.Helper()
+	t.Cleanup(ResetChannels)
+	ch, err := GetOrCreateChannel(name, ChannelOptions{
+		Size: 1, One2One: true, Full: "block",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubN(t, ch, 1)
+	return ch
+}
+
+func TestFullBlock(t *testing.T) {
+	c := mustCreateFull(t, "test/full")
+	errch := blockedPub(t, c)
+
+	if _, has := c.Poll(0); !has {
+		t.Fatal("no message to take")
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFullBlockDelete(t *testing.T) {
+	c := mustCreateFull(t, "test/full")
+	errch := blockedPub(t, c)
+
+	DeleteChannel("test/full")
+	if err := <-errch; err != ErrChannelNotFound {
+		t.Fatalf("Pub to a deleted channel: %v", err)
+	}
+}
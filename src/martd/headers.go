@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+	Messages can carry headers, like a content type, source or trace id,
+	set by the publisher and handed to subscribers as they are, so opaque
+	payloads need not wrap them. Like ids, they come in the headers of the
+	channel response, lined up with payload, and responses only have them
+	if one of their messages has some. Over http they are given as
+	header=name:value, once for each.
+*/
+
+// PubWithHeaders is Pub, with headers attached to the message.
+func (c *Channel) PubWithHeaders(
+	data []byte, headers map[string]string,
+) (int64, error) {
+	if len(headers) == 0 {
+		return c.Pub(data)
+	}
+	etag, _, err := c.pubMessage(data, "", headers)
+	return etag, err
+}
+
+// headers returns r.Headers, or as many nil headers as r has messages.
+func (r *ChanResponse) headers() []map[string]string {
+	if r.Headers != nil {
+		return r.Headers
+	}
+	return make([]map[string]string, len(r.Payload))
+}
+
+// parseHeaders turns name:value pairs into headers, nil if there are none.
+func parseHeaders(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		i := strings.Index(pair, ":")
+		if i <= 0 {
+			return nil, errors.New("invalid header: " + pair)
+		}
+		headers[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return headers, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+/*
+	/healthz answers 200 whenever the server answers at all, for liveness
+	probes. /readyz answers 200 once channels are restored and the db and
+	wal, if any, are open, and 503 before that, or if they can not be used,
+	or when shutting down, for readiness probes. Neither needs a key, and
+	both only send the counters of stats, which do not have to look at
+	every channel.
+*/
+
+var ready int32
+
+// SetReady tells /readyz that startup is done.
+func SetReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+// notReady tells why the server should not get traffic, nil if it should.
+func notReady() error {
+	if atomic.LoadInt32(&ready) == 0 {
+		return errors.New("starting up")
+	}
+	if ShuttingDown() {
+		return ErrShuttingDown
+	}
+	if err := PersistDB.Ping(); err != nil {
+		return err
+	}
+
+	walLock.Lock()
+	open := wal != nil
+	walLock.Unlock()
+	if WALFile != "" && !open {
+		return errors.New("wal is not open")
+	}
+	return nil
+}
+
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, nil)
+}
+
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, notReady())
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	h := counters()
+	h["status"] = "ok"
+	status := http.StatusOK
+	if err != nil {
+		h["status"] = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	j, err := json.Marshal(h)
+	if err != nil {
+		rejectStatus(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+	Hooks let other code know when channels come and go, and when they get
+	their first subscriber or lose their last one, say to start an upstream
+	feed only while someone listens. Hooks run one at a time, in order, on
+	their own goroutine, never with any channel locked, so they can call
+	back into the package.
+
+	Subscriptions are one shot, so a long polling client leaves and comes
+	back after every message, and first subscriber and last unsubscribe
+	hooks may run as often.
+*/
+
+var (
+	hooksLock       sync.RWMutex
+	createHooks     []func(*Channel)
+	deleteHooks     []func(string)
+	firstSubHooks   []func(*Channel)
+	lastUnSubHooks  []func(*Channel)
+	hookQueue       []func()
+	hookQueueLock   sync.Mutex
+	hookQueueSignal = sync.NewCond(&hookQueueLock)
+)
+
+func init() {
+	go runHooks()
+}
+
+// OnChannelCreate calls f with every channel created from now on.
+func OnChannelCreate(f func(*Channel)) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	createHooks = append(createHooks, f)
+}
+
+// OnChannelDelete calls f with the name of every channel deleted or expired
+// from now on.
+func OnChannelDelete(f func(name string)) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	deleteHooks = append(deleteHooks, f)
+}
+
+// OnFirstSubscriber calls f when a channel with no subscribers gets one.
+func OnFirstSubscriber(f func(*Channel)) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	firstSubHooks = append(firstSubHooks, f)
+}
+
+// OnLastUnsubscribe calls f when the last subscriber of a channel leaves.
+func OnLastUnsubscribe(f func(*Channel)) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	lastUnSubHooks = append(lastUnSubHooks, f)
+}
+
+// queueHook has f run by runHooks. It never blocks, so it is safe to call
+// with locks held.
+func queueHook(f func()) {
+	hookQueueLock.Lock()
+	hookQueue = append(hookQueue, f)
+	hookQueueLock.Unlock()
+	hookQueueSignal.Signal()
+}
+
+func runHooks() {
+	for {
+		hookQueueLock.Lock()
+		for len(hookQueue) == 0 {
+			hookQueueSignal.Wait()
+		}
+		queue := hookQueue
+		hookQueue = nil
+		hookQueueLock.Unlock()
+
+		for _, f := range queue {
+			f()
+		}
+	}
+}
+
+func channelHooks(hooks *[]func(*Channel), c *Channel) {
+	hooksLock.RLock()
+	fs := *hooks
+	hooksLock.RUnlock()
+	if len(fs) == 0 {
+		return
+	}
+	queueHook(func() {
+		for _, f := range fs {
+			f(c)
+		}
+	})
+}
+
+func channelCreated(c *Channel)  { channelHooks(&createHooks, c) }
+func firstSubscriber(c *Channel) { channelHooks(&firstSubHooks, c) }
+func lastUnsubscribe(c *Channel) { channelHooks(&lastUnSubHooks, c) }
+
+func channelDeleted(name string) {
+	hooksLock.RLock()
+	fs := deleteHooks
+	hooksLock.RUnlock()
+	if len(fs) == 0 {
+		return
+	}
+	queueHook(func() {
+		for _, f := range fs {
+			f(name)
+		}
+	})
+}
@@ -2,21 +2,31 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/amitu/gutils"
 )
 
 type ChanResponse struct {
-	Etag    string   `json:"etag"`
-	Payload []string `json:"payload"`
+	Etag     string              `json:"etag"`
+	Payload  []string            `json:"payload"`
+	IDs      []string            `json:"ids,omitempty"`      // of payload, if any has one
+	Headers  []map[string]string `json:"headers,omitempty"`  // same
+	Lost     bool                `json:"lost,omitempty"`     // messages after etag evicted
+	Drained  bool                `json:"drained,omitempty"`  // sealed channel is gone
+	More     bool                `json:"more,omitempty"`     // of the backlog, past etag
+	Count    int                 `json:"count,omitempty"`    // of payload, see CountOnly
+	Encoding string              `json:"encoding,omitempty"` // of payload, "base64" or ""
+	etags    []int64             // of payload, for ndjson
+	msgs     []*Message          // of payload, for leasing them, see ack.go
 }
 
 type SubResponse struct {
@@ -24,6 +34,44 @@ type SubResponse struct {
 	Error    string                   `json:"error,omitempty"`
 }
 
+// Reverse puts the newest message first, etags stay as they are.
+func (r *ChanResponse) Reverse() {
+	for i, j := 0, len(r.Payload)-1; i < j; i, j = i+1, j-1 {
+		r.Payload[i], r.Payload[j] = r.Payload[j], r.Payload[i]
+	}
+	for i, j := 0, len(r.IDs)-1; i < j; i, j = i+1, j-1 {
+		r.IDs[i], r.IDs[j] = r.IDs[j], r.IDs[i]
+	}
+	for i, j := 0, len(r.Headers)-1; i < j; i, j = i+1, j-1 {
+		r.Headers[i], r.Headers[j] = r.Headers[j], r.Headers[i]
+	}
+	for i, j := 0, len(r.etags)-1; i < j; i, j = i+1, j-1 {
+		r.etags[i], r.etags[j] = r.etags[j], r.etags[i]
+	}
+}
+
+// Reverse is ChanResponse.Reverse for every channel.
+func (r *SubResponse) Reverse() {
+	for _, cr := range r.Channels {
+		cr.Reverse()
+	}
+}
+
+// CountOnly leaves out the messages, keeping only how many there were in
+// Count, and the etag, for clients that only want to know something
+// changed, and fetch it some other way.
+func (r *ChanResponse) CountOnly() {
+	r.Count += len(r.Payload)
+	r.Payload, r.IDs, r.Headers, r.etags = []string{}, nil, nil, nil
+}
+
+// CountOnly is ChanResponse.CountOnly for every channel.
+func (r *SubResponse) CountOnly() {
+	for _, cr := range r.Channels {
+		cr.CountOnly()
+	}
+}
+
 var (
 	HostPort    string
 	Debug       bool
@@ -32,15 +80,10 @@ var (
 	nList       = expvar.NewInt("nList")
 	nSubAll     = expvar.NewInt("nSubAll")
 	nPubAll     = expvar.NewInt("nPubAll")
-	origin      string
 )
 
 func init() {
 	flag.StringVar(&HostPort, "http", ":54321", "HTTP Host:Port")
-	flag.StringVar(
-		&origin, "origin", "",
-		"Access-Control-Allow-Origin (use * for debugging).",
-	)
 	flag.BoolVar(&Debug, "debug", false, "Debug.")
 	ServerStart = time.Now()
 
@@ -48,38 +91,55 @@ func init() {
 }
 
 func reject(w http.ResponseWriter, reason string) {
-	if origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-	}
+	rejectStatus(w, reason, http.StatusBadRequest)
+}
+
+func rejectStatus(w http.ResponseWriter, reason string, status int) {
 	j, err := json.Marshal(SubResponse{Error: reason})
 	if err != nil {
 		log.Println("Error during json.Marshal", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Error(w, string(j), http.StatusBadRequest)
+	http.Error(w, string(j), status)
 }
 
-func respond(w http.ResponseWriter, resp *SubResponse) {
-	if origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-	}
+// unavailable tells the client to go elsewhere, the server is shutting down.
+func unavailable(w http.ResponseWriter) {
+	j, _ := json.Marshal(SubResponse{Error: ErrShuttingDown.Error()})
+	http.Error(w, string(j), http.StatusServiceUnavailable)
+}
+
+// respond writes resp, gzipped if gz, see writeBody.
+func respond(w http.ResponseWriter, resp *SubResponse, gz bool) {
 	j, err := json.Marshal(resp)
 	if err != nil {
 		log.Println("Error during json.Marshal", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Write(j)
+	writeBody(w, j, gz)
 }
 
-func PubHandler(w http.ResponseWriter, r *http.Request) {
-	if origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
+var channelAttributes = []string{
+	"size", "life", "one2one", "latest", "max_subscribers", "binary", "json",
+	"compress", "rate", "burst", "webhook", "coalesce", "full",
+}
+
+// hasChannelAttributes tells if a push says what the channel should be like.
+func hasChannelAttributes(r *http.Request) bool {
+	for _, attr := range channelAttributes {
+		if _, ok := r.Form[attr]; ok {
+			return true
+		}
 	}
+	return false
+}
+
+func PubHandler(w http.ResponseWriter, r *http.Request) {
 	nPubAll.Add(1)
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, form, err := pubBody(r)
 	if err != nil {
 		reject(w, err.Error())
 		return
@@ -89,14 +149,31 @@ func PubHandler(w http.ResponseWriter, r *http.Request) {
 	size_s := r.FormValue("size")
 	life_s := r.FormValue("life")
 	one2one := r.FormValue("one2one") == "true"
+	latest := r.FormValue("latest") == "true"
+	maxSubs_s := r.FormValue("max_subscribers")
+	binary := r.FormValue("binary") == "true"
+	jsonOnly := r.FormValue("json") == "true"
+	compress := r.FormValue("compress") == "true"
+	rate_s := r.FormValue("rate")
+	burst_s := r.FormValue("burst")
 	key := r.FormValue("key")
+	etag_s := r.FormValue("etag")
+	priority_s := r.FormValue("priority")
+	force := r.FormValue("force") == "true"
+	id := r.FormValue("id")
+	webhook := r.FormValue("webhook")
+	coalesce_s := r.FormValue("coalesce")
+	await_s := r.FormValue("await")
 
 	if channel == "" {
 		reject(w, "channel is required")
 		return
 	}
+	if forwardPub(w, r, channel, body, form) {
+		return
+	}
 
-	size := uint(10)
+	size := DefaultSize
 	if size_s != "" {
 		_, err := fmt.Sscan(size_s, &size)
 		if err != nil {
@@ -105,7 +182,7 @@ func PubHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	life := time.Second * 60 * 60 // default expiry = one hr
+	life := DefaultLife
 	if life_s != "" {
 		_, err := fmt.Sscan(life_s, &life)
 		if err != nil {
@@ -114,80 +191,326 @@ func PubHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ch, err := GetOrCreateChannel(channel, size, life, one2one, key)
-	if err != nil {
+	rate := float64(0)
+	if rate_s != "" {
+		if _, err := fmt.Sscan(rate_s, &rate); err != nil {
+			reject(w, "invalid rate: "+err.Error())
+			return
+		}
+	}
+
+	burst := uint(0)
+	if burst_s != "" {
+		if _, err := fmt.Sscan(burst_s, &burst); err != nil {
+			reject(w, "invalid burst: "+err.Error())
+			return
+		}
+	}
+
+	maxSubs := uint(0)
+	if maxSubs_s != "" {
+		if _, err := fmt.Sscan(maxSubs_s, &maxSubs); err != nil {
+			reject(w, "invalid max_subscribers: "+err.Error())
+			return
+		}
+	}
+
+	coalesce := time.Duration(0)
+	if coalesce_s != "" {
+		coalesce, err = time.ParseDuration(coalesce_s)
+		if err == nil && coalesce < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err != nil {
+			reject(w, "invalid coalesce: "+err.Error())
+			return
+		}
+	}
+
+	opts := ChannelOptions{
+		Size: size, Life: life, One2One: one2one, Key: key, Binary: binary,
+		JSON: jsonOnly, Compress: compress, Rate: rate, Burst: burst,
+		MaxSubscribers: maxSubs, Latest: latest, Webhook: webhook,
+		Coalesce: coalesce, Full: r.FormValue("full"),
+	}
+
+	// pushes without attributes go to the channel as it is, pushes with
+	// attributes must match it, or force them on it
+	if err := canSetWebhook(r, channel, webhook); err != nil {
+		rejectStatus(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ch := existingChannel(channel)
+	if ch == nil || hasChannelAttributes(r) {
+		ch, err = GetOrCreateChannel(channel, opts)
+		if err == ErrChannelExists && force {
+			if err = ch.CheckKey(key); err == nil {
+				err = ch.SetOptions(opts)
+			}
+		}
+		if err == ErrChannelExists {
+			rejectStatus(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			reject(w, err.Error())
+			return
+		}
+	}
+
+	if err := ch.CheckKey(key); err != nil {
 		reject(w, err.Error())
 		return
 	}
 
-	if ch.Key != "" && ch.Key != key {
-		reject(w, "invalid key")
+	if id != "" && (etag_s != "" || priority_s != "") {
+		reject(w, "id can not be used with etag or priority")
+		return
+	}
+
+	headers, err := parseHeaders(r.Form["header"])
+	if err != nil {
+		reject(w, err.Error())
 		return
 	}
+	if headers != nil && (etag_s != "" || priority_s != "") {
+		reject(w, "header can not be used with etag or priority")
+		return
+	}
+	if await_s != "" &&
+		(etag_s != "" || priority_s != "" || id != "" || headers != nil) {
+		reject(w, "await can not be used with etag, priority, id or header")
+		return
+	}
+
+	resp := map[string]interface{}{}
+	status := http.StatusOK
 
 	etag := int64(0)
 
-	if len(body) != 0 {
-		etag = ch.Pub(body)
+	if len(body) != 0 && etag_s != "" {
+		// publisher is retrying, publish once only
+		if _, err := fmt.Sscan(etag_s, &etag); err != nil {
+			reject(w, "invalid etag: "+err.Error())
+			return
+		}
+		if _, err := ch.PubWithEtag(body, etag); err != nil {
+			reject(w, err.Error())
+			return
+		}
+	} else if len(body) != 0 && await_s != "" {
+		want := 0
+		if _, err := fmt.Sscan(await_s, &want); err != nil {
+			reject(w, "invalid await: "+err.Error())
+			return
+		}
+		timeout := 5 * time.Second
+		if t := r.FormValue("await_timeout"); t != "" {
+			if timeout, err = time.ParseDuration(t); err != nil {
+				reject(w, "invalid await_timeout: "+err.Error())
+				return
+			}
+			if timeout <= 0 || timeout > MaxAwaitTimeout {
+				reject(w, fmt.Sprintf(
+					"invalid await_timeout: must be more than 0, at most %s",
+					MaxAwaitTimeout,
+				))
+				return
+			}
+		}
+		a := newAwaiter(want)
+		if etag, err = ch.pubAwait(body, a); err != nil {
+			reject(w, err.Error())
+			return
+		}
+		delivered, err := a.wait(timeout)
+		resp["delivered"] = delivered
+		if err != nil {
+			resp["error"] = err.Error()
+			status = http.StatusGatewayTimeout
+		}
+	} else if len(body) != 0 && (id != "" || headers != nil) {
+		etag, _, err = ch.pubMessage(body, id, headers)
+		if err != nil {
+			reject(w, err.Error())
+			return
+		}
+	} else if len(body) != 0 && priority_s != "" {
+		priority := 0
+		if _, err := fmt.Sscan(priority_s, &priority); err != nil {
+			reject(w, "invalid priority: "+err.Error())
+			return
+		}
+		etag, err = ch.PubPriority(body, priority)
+		if err != nil {
+			reject(w, err.Error())
+			return
+		}
+	} else if len(body) != 0 {
+		etag, err = ch.Pub(body)
+		if err != nil {
+			reject(w, err.Error())
+			return
+		}
 	}
 
-	j, err := json.MarshalIndent(
-		map[string]string{"etag": fmt.Sprintf("%d", etag)}, " ", "    ",
-	)
+	if cn := clientIdentity(r); cn != "" && Log != nil {
+		Log.Debugf("pub %s %d by %s", channel, etag, cn)
+	}
+
+	resp["etag"] = fmt.Sprintf("%d", etag)
+	j, err := json.MarshalIndent(resp, " ", "    ")
 
 	if err != nil {
 		reject(w, err.Error())
 		return
 	}
 
+	w.WriteHeader(status)
 	fmt.Fprintf(w, "%s", j)
 }
 
-func SubHandler(w http.ResponseWriter, r *http.Request) {
-	nSub.Add(1)
-	nSubAll.Add(1)
-	defer nSub.Add(-1)
+// subRequest is what a client asks for in /sub (or /ws). Every form value
+// not in subParams is a channel name (or pattern) with etag as the value.
+type subRequest struct {
+	etags     map[string]int64
+	patterns  []string
+	key       string
+	heartbeat time.Duration
+	opts      SubOptions
+	poll      bool // answer right away, 304 if nothing is new
+	reverse   bool // newest message first
+	gzip      bool // client takes gzipped responses
+	ndjson    bool // one line per message, see ndjson.go
+	items     bool // cursor and items, see envelope.go
+	countOnly bool // just etags and counts, no messages
+}
+
+var subParams = map[string]bool{
+	"cid": true, "key": true, "heartbeat": true, "prefix": true, "where": true,
+	"poll": true, "presence": true, "buffer": true, "reverse": true,
+	"max_age": true, "max_backlog": true, "format": true, "min_etag": true,
+	"count_only": true,
+}
 
+func parseSubRequest(r *http.Request) (*subRequest, error) {
 	r.ParseForm()
-	evch := make(chan *ChannelEvent)
 
-	subs := make([]*Channel, 0)
-	resp := &SubResponse{make(map[string]*ChanResponse), ""}
+	req := &subRequest{
+		etags: make(map[string]int64), patterns: []string{},
+		key: r.FormValue("key"), poll: r.FormValue("poll") == "true",
+		reverse: r.FormValue("reverse") == "true", gzip: acceptsGzip(r),
+		ndjson: wantsNDJSON(r), items: wantsItems(r),
+		countOnly: r.FormValue("count_only") == "true",
+	}
+
+	if hb := r.FormValue("heartbeat"); hb != "" {
+		var err error
+		req.heartbeat, err = time.ParseDuration(hb)
+		if err != nil || req.heartbeat <= 0 {
+			return nil, errors.New("invalid heartbeat: " + hb)
+		}
+	}
+
+	filter, err := parseFilter(r.FormValue("prefix"), r.FormValue("where"))
+	if err != nil {
+		return nil, err
+	}
+	req.opts = SubOptions{
+		Filter: filter, Identity: r.FormValue("presence"),
+		CID: r.FormValue("cid"),
+	}
+	if cn := clientIdentity(r); cn != "" {
+		req.opts.Identity = cn
+	}
+	if age := r.FormValue("max_age"); age != "" {
+		var err error
+		req.opts.MaxAge, err = time.ParseDuration(age)
+		if err != nil || req.opts.MaxAge < 0 {
+			return nil, errors.New("invalid max_age: " + age)
+		}
+	}
+	if n := r.FormValue("max_backlog"); n != "" {
+		if _, err := fmt.Sscan(n, &req.opts.MaxBacklog); err != nil {
+			return nil, errors.New("invalid max_backlog: " + n)
+		}
+	}
+	if e := r.FormValue("min_etag"); e != "" {
+		if _, err := fmt.Sscan(e, &req.opts.MinEtag); err != nil {
+			return nil, errors.New("invalid min_etag: " + e)
+		}
+	}
+	if b := r.FormValue("buffer"); b != "" {
+		_, err := fmt.Sscan(b, &req.opts.Buffer)
+		if err != nil || req.opts.Buffer < 0 || req.opts.Buffer > MaxSubBuffer {
+			return nil, fmt.Errorf(
+				"invalid buffer: %s, must be 0 to %d", b, MaxSubBuffer,
+			)
+		}
+	}
 
 	for k := range r.Form {
-		if k == "cid" {
+		if subParams[k] {
 			continue
 		}
+
+		if strings.Contains(k, "*") {
+			if err := ValidatePattern(k); err != nil {
+				return nil, errors.New(k + ": " + err.Error())
+			}
+			req.patterns = append(req.patterns, k)
+			continue
+		}
+
 		v := r.FormValue(k)
 		if v == "" {
-			reject(w, k+" has no etag")
-			return
+			return nil, errors.New(k + " has no etag")
 		}
 
 		etag := int64(0)
 		_, err := fmt.Sscan(v, &etag)
 		if err != nil {
-			reject(w, "invalid etag: "+err.Error())
-			return
+			return nil, errors.New("invalid etag: " + err.Error())
 		}
 
-		ch := GetChannel(k)
-		has, ith := ch.HasNew(etag)
-		if has {
-			ch.Append(resp, ith)
-		} else {
-			subs = append(subs, ch)
+		if err := ValidateChannelName(k); err != nil {
+			return nil, errors.New(k + ": " + err.Error())
 		}
+
+		if peerTrusted(r) {
+			// relaying, see peers.go
+		} else if err := peekChannel(k).CheckKey(req.key); err != nil {
+			return nil, errors.New(k + ": " + err.Error())
+		}
+
+		req.etags[k] = etag
 	}
 
-	if len(resp.Channels) != 0 {
-		respond(w, resp)
+	if req.items && (len(req.etags) != 1 || len(req.patterns) != 0) {
+		return nil, errors.New("format=items takes exactly one channel")
+	}
+	return req, nil
+}
+
+func SubHandler(w http.ResponseWriter, r *http.Request) {
+	nSub.Add(1)
+	nSubAll.Add(1)
+	defer nSub.Add(-1)
+
+	if ShuttingDown() {
+		unavailable(w)
+		return
+	}
+
+	req, err := parseSubRequest(r)
+	if err != nil {
+		reject(w, err.Error())
 		return
 	}
 
-	// sub everything
-	for _, ch := range subs {
-		ch.Sub(evch)
+	if req.poll {
+		poll(w, req)
+		return
 	}
 
 	cner, ok := w.(http.CloseNotifier)
@@ -196,18 +519,313 @@ func SubHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	select {
-	case cm := <-evch:
-		resp.Channels[cm.Chan.Name] = &ChanResponse{
-			fmt.Sprintf("%d", cm.Mesg.Created), []string{string(cm.Mesg.Data)},
+	// each channel sends at most one event before dropping its clients, so
+	// with one slot per channel no Pub ever blocks on us, even after we have
+	// stopped listening. Patterns can match any number of channels, those
+	// may have to wait for SendTimeout.
+	evch := req.opts.EventChan(len(req.etags) + len(req.patterns) + 1)
+	resp, subs := MultiSub(r.Context(), req.etags, req.opts, evch)
+	if resp.Error != "" {
+		reject(w, resp.Error)
+		return
+	}
+	if len(resp.Channels) != 0 {
+		req.respond(w, resp)
+		return
+	}
+	defer MultiUnSub(subs, evch)
+
+	for _, pattern := range req.patterns {
+		defer UnSubPattern(SubPattern(pattern, req.key, evch))
+	}
+
+	if req.heartbeat != 0 {
+		defer Heartbeat(evch, req.heartbeat)()
+	}
+
+	for {
+		select {
+		case cm := <-evch:
+			if cm.Heartbeat {
+				keepalive(w)
+				req.gzip = false // headers are out
+				continue
+			}
+			if cm.Shutdown {
+				unavailable(w)
+				return
+			}
+			if cm.Reaped {
+				// waited too long, the client comes back with its etag
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			resp.Channels[cm.Chan.Name] = eventResponse(cm)
+			req.respond(w, resp)
+		case <-cner.CloseNotify():
+		}
+		return
+	}
+}
+
+// poll answers a /sub?poll=true without waiting. Patterns are ignored.
+func poll(w http.ResponseWriter, req *subRequest) {
+	resp := &SubResponse{Channels: make(map[string]*ChanResponse)}
+	for name, etag := range req.etags {
+		if cr, ok := peekChannel(name).PollOptions(etag, req.opts); ok {
+			resp.Channels[name] = cr
+		}
+	}
+	if len(resp.Channels) == 0 {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	req.respond(w, resp)
+}
+
+// respond is respond, newest message first if the client asked for that.
+func (req *subRequest) respond(w http.ResponseWriter, resp *SubResponse) {
+	if req.reverse {
+		resp.Reverse()
+	}
+	if req.countOnly {
+		resp.CountOnly()
+	}
+	if req.ndjson {
+		respondNDJSON(w, resp, req.gzip)
+		return
+	}
+	if req.items {
+		respondItems(w, resp, req.gzip)
+		return
+	}
+	respond(w, resp, req.gzip)
+}
+
+func eventResponse(cm *ChannelEvent) *ChanResponse {
+	if cm.Mesg == nil {
+		// channel is gone, client has to start over with etag 0
+		return &ChanResponse{
+			Etag: "0", Payload: []string{}, Drained: cm.Drained,
+		}
+	}
+	resp := &ChanResponse{
+		Etag:     fmt.Sprintf("%d", cm.Mesg.Created),
+		Payload:  []string{},
+		Encoding: cm.Chan.encoding(),
+	}
+	for _, m := range cm.Messages() {
+		resp.add(cm.Chan, m, m.Payload())
+	}
+	return resp
+}
+
+// keepalive writes a bit of whitespace, which json parsers skip, so proxies
+// see traffic on an idle long poll.
+func keepalive(w http.ResponseWriter) {
+	w.Write([]byte("\n"))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RecentHandler serves the last n messages of a channel, without
+// subscribing.
+func RecentHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if err := ValidateChannelName(channel); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	n := uint(10)
+	if n_s := r.FormValue("n"); n_s != "" {
+		if _, err := fmt.Sscan(n_s, &n); err != nil {
+			reject(w, "invalid n: "+err.Error())
+			return
 		}
-		respond(w, resp)
-	case <-cner.CloseNotify():
 	}
 
-	for _, ch := range subs {
-		ch.UnSub(evch)
+	ch := peekChannel(channel)
+	if err := ch.CheckKey(r.FormValue("key")); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	resp := ch.Recent(n)
+	if r.FormValue("reverse") == "true" {
+		resp.Reverse()
+	}
+	sr := &SubResponse{Channels: map[string]*ChanResponse{channel: resp}}
+	if wantsNDJSON(r) {
+		respondNDJSON(w, sr, acceptsGzip(r))
+		return
+	}
+	if wantsItems(r) {
+		respondItems(w, sr, acceptsGzip(r))
+		return
+	}
+	respond(w, sr, acceptsGzip(r))
+}
+
+// StatsHandler serves the stats of one channel.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if channel == "" {
+		StatsPageHandler(w, r)
+		return
+	}
+	if err := ValidateChannelName(channel); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	ch := peekChannel(channel)
+	if err := ch.CheckKey(r.FormValue("key")); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	j, err := ch.StatsJson(r.FormValue("etags") == "number")
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// StatsPageHandler serves a page of the stats of all channels, see
+// ChannelStatsPage.
+func StatsPageHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if l := r.FormValue("limit"); l != "" {
+		if _, err := fmt.Sscan(l, &limit); err != nil {
+			reject(w, "invalid limit: "+err.Error())
+			return
+		}
+	}
+
+	page := ChannelStatsPage(r.FormValue("prefix"), r.FormValue("after"), limit)
+	j, err := page.Json(r.FormValue("etags") == "number")
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// SealHandler seals a channel, see Seal.
+func SealHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if err := ValidateChannelName(channel); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	ch := existingChannel(channel)
+	if ch == nil {
+		rejectStatus(w, ErrChannelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := ch.CheckKey(r.FormValue("key")); err != nil {
+		reject(w, err.Error())
+		return
+	}
+	if err := ch.Seal(); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	j, err := ch.StatsJson(r.FormValue("etags") == "number")
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// PresenceHandler lists who is subscribed to a channel.
+func PresenceHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if err := ValidateChannelName(channel); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	ch := peekChannel(channel)
+	if err := ch.CheckKey(r.FormValue("key")); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	j, err := json.Marshal(ch.Presence())
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// createRequest is the body of POST /channels.
+type createRequest struct {
+	Name string `json:"name"`
+	ChannelOptions
+}
+
+// ChannelsHandler lists channels, or with POST creates one.
+func ChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		CreateChannelHandler(w, r)
+		return
 	}
+
+	j, err := json.Marshal(ListChannelsPrefix(r.FormValue("prefix")))
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// CreateChannelHandler creates the channel described by the json body. It
+// is 201 if the channel is new, 200 if it was there with the same options,
+// and 409 if it was there with other options.
+func CreateChannelHandler(w http.ResponseWriter, r *http.Request) {
+	req := &createRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		reject(w, "invalid body: "+err.Error())
+		return
+	}
+
+	if err := canSetWebhook(r, req.Name, req.Webhook); err != nil {
+		rejectStatus(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ch, created, err := CreateChannel(req.Name, req.ChannelOptions)
+	if err == ErrChannelExists {
+		rejectStatus(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	j, err := ch.StatsJson(r.FormValue("etags") == "number")
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(j)
 }
 
 func ListHandler(w http.ResponseWriter, r *http.Request) {
@@ -219,15 +837,42 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 
 func ServeHTTP() {
 	http.HandleFunc("/list", ListHandler)
+	http.HandleFunc("/channels", ChannelsHandler)
+	http.HandleFunc("/channels/", AdminChannelHandler)
 	http.HandleFunc("/pub", PubHandler)
 	http.HandleFunc("/sub", SubHandler)
+	http.HandleFunc("/recent", RecentHandler)
+	http.HandleFunc("/presence", PresenceHandler)
+	http.HandleFunc("/stats", StatsHandler)
+	http.HandleFunc("/seal", SealHandler)
+	http.HandleFunc("/ack", AckHandler)
+	http.HandleFunc("/healthz", HealthzHandler)
+	http.HandleFunc("/readyz", ReadyzHandler)
+	http.HandleFunc("/ws", WebSocketHandler)
+	http.HandleFunc("/events", SSEHandler)
+	http.Handle("/metrics", MetricsHandler())
 	http.Handle("/", http.FileServer(FS(Debug)))
 
+	config, err := TLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Printf("Started HTTP Server on %s.", HostPort)
-	logger := gutils.NewApacheLoggingHandler(http.DefaultServeMux, os.Stderr)
-	server := &http.Server{
-		Addr:    HostPort,
-		Handler: logger,
+	handler := CORS(http.DefaultServeMux)
+	logger := gutils.NewApacheLoggingHandler(handler, os.Stderr)
+	Server = &http.Server{
+		Addr:      HostPort,
+		Handler:   logger,
+		TLSConfig: config,
+	}
+	if config != nil {
+		err = Server.ListenAndServeTLS("", "")
+	} else {
+		err = Server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	log.Fatal(server.ListenAndServe())
+	<-shutdownDone
 }
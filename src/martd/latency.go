@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Each channel keeps how long its messages took to reach subscribers,
+	from being pushed to being sent on their evch, and how long each fanout
+	took to send to all of them. A fanout much slower than the delivery
+	latency is slow subscribers holding up publishers. Fanout workers tally
+	on their own and add to the channel once they are done, so the channel
+	lock is not taken per delivery. The latency of a message published with
+	an etag of its own is counted from that etag.
+*/
+
+// latency tallies durations, in nanoseconds.
+type latency struct {
+	lock  sync.Mutex
+	count int64
+	sum   int64
+	min   int64
+	max   int64
+}
+
+// LatencyStats is a latency in ChannelStats.
+type LatencyStats struct {
+	Count int64         `json:"count"`
+	Min   time.Duration `json:"min"`
+	Avg   time.Duration `json:"avg"`
+	Max   time.Duration `json:"max"`
+}
+
+// add tallies d, it needs no lock, for tallies of one goroutine.
+func (l *latency) add(d int64) {
+	if d < 0 {
+		d = 0 // etag from the future, given by the publisher
+	}
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.sum += d
+}
+
+// merge adds the tally of o to l.
+func (l *latency) merge(o *latency) {
+	if o.count == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.count == 0 || o.min < l.min {
+		l.min = o.min
+	}
+	if o.max > l.max {
+		l.max = o.max
+	}
+	l.count += o.count
+	l.sum += o.sum
+}
+
+// record is add, for tallies shared between goroutines.
+func (l *latency) record(d int64) {
+	one := latency{}
+	one.add(d)
+	l.merge(&one)
+}
+
+// stats returns the tally so far, nil if there is none.
+func (l *latency) stats() *LatencyStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.count == 0 {
+		return nil
+	}
+	return &LatencyStats{
+		Count: l.count, Min: time.Duration(l.min),
+		Avg: time.Duration(l.sum / l.count), Max: time.Duration(l.max),
+	}
+}
+
+// tally is the count and sum of a latency, for /metrics.
+type tally struct {
+	count int64
+	sum   time.Duration
+}
+
+func (l *latency) sums() tally {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return tally{l.count, time.Duration(l.sum)}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+/*
+	Logger gets told what channels are up to: created and dropped channels,
+	publishes and subscribes, dropped deliveries, evictions and bad keys.
+	It is nil, and nothing is logged, unless -log-level is set, or Log is
+	set to some other Logger. Publishes and subscribes are only logged at
+	debug, there are too many of them for anything else, and call sites
+	check Log != nil themselves, so the arguments are not even boxed when
+	logging is off.
+*/
+
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+)
+
+var (
+	Log      Logger
+	LogLevel string
+)
+
+func init() {
+	flag.StringVar(
+		&LogLevel, "log-level", "",
+		"Log channel events at debug, info or warn (default none).",
+	)
+}
+
+// SetupLogger sets Log as per -log-level, to log via the log package.
+func SetupLogger() error {
+	switch LogLevel {
+	case "":
+	case "debug":
+		Log = &stdLogger{LevelDebug}
+	case "info":
+		Log = &stdLogger{LevelInfo}
+	case "warn":
+		Log = &stdLogger{LevelWarn}
+	default:
+		return fmt.Errorf("invalid log-level: %s", LogLevel)
+	}
+	return nil
+}
+
+type stdLogger struct {
+	level int
+}
+
+func (l *stdLogger) logf(level int, prefix, format string, args ...interface{}) {
+	if level >= l.level {
+		log.Printf(prefix+format, args...)
+	}
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, "DEBUG ", format, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, "INFO ", format, args...)
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, "WARN ", format, args...)
+}
+
+func infof(format string, args ...interface{}) {
+	if Log != nil {
+		Log.Infof(format, args...)
+	}
+}
+
+func warnf(format string, args ...interface{}) {
+	if Log != nil {
+		Log.Warnf(format, args...)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"runtime"
 	"time"
 )
@@ -19,9 +20,46 @@ func DebugRoutine() {
 
 func main() {
 	flag.Parse()
+	if err := SetupLogger(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := LoadNamespaceKeys(); err != nil {
+		log.Fatalln("Could not read namespace keys:", err)
+	}
+	if err := SetupPeers(); err != nil {
+		log.Fatalln("Could not set up peers:", err)
+	}
+	if err := SetupCORS(); err != nil {
+		log.Fatalln("Could not set up cors:", err)
+	}
+	if err := SetupMemory(); err != nil {
+		log.Fatalln("Could not set up memory budget:", err)
+	}
+	if err := SetupMaxChannels(); err != nil {
+		log.Fatalln("Could not set up max channels:", err)
+	}
 	ReadChannels()
-
+	if err := OpenPersistDB(); err != nil {
+		log.Panicln("Could not open DB", err)
+	}
+	// before replaying the wal, which deletes what is gone from the db too
 	go Persister()
+	if SnapshotFile != "" {
+		if err := ReadSnapshot(); err != nil {
+			log.Fatalln("Could not read snapshot:", err)
+		}
+	}
+	if WALFile != "" {
+		if err := OpenWAL(); err != nil {
+			log.Fatalln("Could not open wal:", err)
+		}
+	}
+	if SnapshotFile != "" {
+		go Snapshotter()
+	}
+
+	go ShutdownOnSignal()
+	SetReady()
 	if Debug {
 		go DebugRoutine()
 	}
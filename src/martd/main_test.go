@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain drains PersistChan, as nothing is persisted while testing.
+func TestMain(m *testing.M) {
+	go func() {
+		for range PersistChan {
+		}
+	}()
+	os.Exit(m.Run())
+}
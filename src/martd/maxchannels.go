@@ -0,0 +1,173 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"flag"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	MaxChannels caps how many channels can be created, so a client making
+	up a new channel name for every push can not fill up memory with them.
+	Once there are that many, ChannelPolicy decides what happens to a new
+	one: "reject" fails creating it with ErrTooManyChannels, "evict"
+	deletes the channel that has gone longest without a push or a
+	subscribe to make room, its subscribers are told it is gone, as if it
+	was deleted. With ProtectActive channels that have subscribers are
+	never evicted, if all of them have creating fails as with reject.
+	Channels already there keep working either way. Expired and deleted
+	channels make room again. Channels subscribers are waiting on, that have
+	not been created or published to, do not count, nor do ones made by
+	NewChannel.
+
+	For evicting, created channels are kept in lru, least recently pushed
+	to or subscribed to first, so finding the stalest one does not have to
+	look at every channel.
+*/
+
+var (
+	MaxChannels   uint
+	ChannelPolicy string
+	ProtectActive bool
+	liveChannels  int64 // created channels in the shards, atomic
+	nChanEvicted  = expvar.NewInt("nChanEvicted")
+
+	lru     = list.New() // of *Channel, stalest first, when evicting
+	lruLock sync.Mutex   // for lru and the lruElem of every channel
+)
+
+func init() {
+	flag.UintVar(
+		&MaxChannels, "max-channels", 0,
+		"Most channels there can be at once (0 for no limit).",
+	)
+	flag.StringVar(
+		&ChannelPolicy, "channel-policy", "reject",
+		"What to do when max-channels is reached: reject or evict.",
+	)
+	flag.BoolVar(
+		&ProtectActive, "protect-active", false,
+		"Never evict channels that have subscribers.",
+	)
+}
+
+// SetupMaxChannels checks -channel-policy.
+func SetupMaxChannels() error {
+	if ChannelPolicy != "reject" && ChannelPolicy != "evict" {
+		return errors.New("invalid channel-policy: " + ChannelPolicy)
+	}
+	return nil
+}
+
+// evicting tells if channels are evicted to make room for new ones.
+func evicting() bool {
+	return MaxChannels != 0 && ChannelPolicy == "evict"
+}
+
+// makeRoomForChannel evicts channels till there is room for one more, if
+// ChannelPolicy says so. Returns false if it had to but could not. Must be
+// called without holding any channel or shard lock.
+func makeRoomForChannel() bool {
+	if !evicting() {
+		return true
+	}
+	for LiveChannels() >= int(MaxChannels) {
+		if !evictStalest() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictStalest deletes the channel that has gone longest without a push or
+// a subscribe. Returns false if there was none to delete.
+func evictStalest() bool {
+	var stalest *Channel
+	lruLock.Lock()
+	for e := lru.Front(); e != nil; e = e.Next() {
+		ch := e.Value.(*Channel)
+		if !ProtectActive || atomic.LoadInt32(&ch.nClients) == 0 {
+			stalest = ch
+			break
+		}
+	}
+	lruLock.Unlock()
+	if stalest == nil {
+		return false
+	}
+
+	if !deleteChannel(stalest) {
+		return true // gone already, look again
+	}
+	nChanEvicted.Add(1)
+	infof("evicted channel %s, max channels reached", stalest.Name)
+	return true
+}
+
+// reserveChannel makes room for one more channel, or returns
+// ErrTooManyChannels. Must be called with the shard of the new channel
+// locked.
+func reserveChannel() error {
+	n := atomic.AddInt64(&liveChannels, 1)
+	if MaxChannels != 0 && n > int64(MaxChannels) {
+		atomic.AddInt64(&liveChannels, -1)
+		return ErrTooManyChannels
+	}
+	return nil
+}
+
+// channelGone gives back the room c took, once it is out of its shard.
+// Must be called with that shard locked.
+func channelGone(c *Channel) {
+	if c.inited {
+		atomic.AddInt64(&liveChannels, -1)
+	}
+	lruLock.Lock()
+	if c.lruElem != nil {
+		lru.Remove(c.lruElem)
+		c.lruElem = nil
+	}
+	lruLock.Unlock()
+}
+
+// channelUsed marks c as just pushed to or subscribed to, for evicting,
+// once lruAdd has put it in lru.
+func channelUsed(c *Channel) {
+	if !evicting() {
+		return
+	}
+	lruLock.Lock()
+	if c.lruElem != nil {
+		lru.MoveToBack(c.lruElem)
+	}
+	lruLock.Unlock()
+}
+
+// lruAdd puts a newly created c at the back of lru. Must be called with the
+// shard of c locked.
+func lruAdd(c *Channel) {
+	if !evicting() || c.detached {
+		return
+	}
+	lruLock.Lock()
+	c.lruElem = lru.PushBack(c)
+	lruLock.Unlock()
+}
+
+// resetLRU forgets all channels, for ResetChannels.
+func resetLRU() {
+	lruLock.Lock()
+	for e := lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*Channel).lruElem = nil
+	}
+	lru.Init()
+	lruLock.Unlock()
+}
+
+// LiveChannels returns how many channels count towards MaxChannels.
+func LiveChannels() int {
+	return int(atomic.LoadInt64(&liveChannels))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// evictAt has channels evicted once there are max, till the test is done.
+func evictAt(t *testing.T, max uint, protect bool) {
+	max0, policy, protect0 := MaxChannels, ChannelPolicy, ProtectActive
+	t.Cleanup(func() {
+		ResetChannels()
+		MaxChannels, ChannelPolicy, ProtectActive = max0, policy, protect0
+	})
+	ResetChannels()
+	MaxChannels, ChannelPolicy, ProtectActive = max, "evict", protect
+}
+
+func mustCreate(t *testing.T, name string) *Channel {
+	t.Helper()
+	ch, err := GetOrCreateChannel(name, ChannelOptions{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestEvictStalest(t *testing.T) {
+	evictAt(t, 3, false)
+	a, _, _ := mustCreate(t, "test/a"), mustCreate(t, "test/b"), mustCreate(t, "test/c")
+	pubN(t, a, 1)
+
+	mustCreate(t, "test/d")
+	if ChannelExists("test/b") || !ChannelExists("test/a") {
+		t.Fatalf("evicted the wrong channel, left %v", ListChannels())
+	}
+	evch := make(chan *ChannelEvent, 1)
+	if err := GetChannel("test/c").Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, "test/e")
+	if ChannelExists("test/a") || LiveChannels() != 3 {
+		t.Fatalf("evicted the wrong channel, left %v", ListChannels())
+	}
+}
+
+func TestEvictProtectActive(t *testing.T) {
+	evictAt(t, 2, true)
+	a, _ := mustCreate(t, "test/a"), mustCreate(t, "test/b")
+	evch := make(chan *ChannelEvent, 1)
+	if err := a.Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+
+	mustCreate(t, "test/c")
+	if !ChannelExists("test/a") || ChannelExists("test/b") {
+		t.Fatalf("evicted the wrong channel, left %v", ListChannels())
+	}
+	if err := GetChannel("test/c").Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetOrCreateChannel("test/d", ChannelOptions{Size: 10}); err != ErrTooManyChannels {
+		t.Fatalf("GetOrCreateChannel with all active = %v", err)
+	}
+}
+
+func TestEvictConcurrent(t *testing.T) {
+	evictAt(t, 10, false)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := GetOrCreateChannel(
+				fmt.Sprintf("test/%d", i), ChannelOptions{Size: 10},
+			)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := LiveChannels(); n != 10 || len(ListChannels()) != 10 {
+		t.Fatalf("%d live channels, %d listed", n, len(ListChannels()))
+	}
+}
+
+func TestSetupMaxChannels(t *testing.T) {
+	defer func(policy string) { ChannelPolicy = policy }(ChannelPolicy)
+	for policy, ok := range map[string]bool{
+		"reject": true, "evict": true, "lru": false,
+	} {
+		ChannelPolicy = policy
+		if err := SetupMaxChannels(); (err == nil) != ok {
+			t.Errorf("SetupMaxChannels with %q = %v", policy, err)
+		}
+	}
+}
+
+func TestShellDropped(t *testing.T) {
+	defer func(linger time.Duration) { shellLinger = linger }(shellLinger)
+	shellLinger = 10 * time.Millisecond
+	defer ResetChannels()
+	ResetChannels()
+
+	evch := make(chan *ChannelEvent, 1)
+	for _, name := range []string{"test/gone", "test/waited", "test/created"} {
+		if err := GetChannel(name).Sub(evch); err != nil {
+			t.Fatal(err)
+		}
+		GetChannel(name).UnSub(evch)
+	}
+	if err := GetChannel("test/waited").Sub(evch); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, "test/created")
+
+	time.Sleep(50 * time.Millisecond)
+	if n := NumChannels(); n != 2 {
+		t.Fatalf("%d channels left, want 2", n)
+	}
+	if !ChannelExists("test/created") {
+		t.Fatal("dropped a created channel")
+	}
+}
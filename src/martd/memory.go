@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"flag"
+	"sync/atomic"
+)
+
+/*
+	All messages live in memory, MemBudget caps how many bytes of message
+	data all channels together can hold. When a Pub would go over it,
+	MemPolicy decides what happens: "reject" fails the Pub with
+	ErrMemoryFull, "evict" drops oldest messages of the biggest channels
+	till the new message fits.
+
+	A Pub reserves what it needs up front, adding it to memUsed, so
+	concurrent ones can not all squeeze into the same free bytes, and gives
+	it back once the message is in its array, which counts it from then on,
+	or has failed to get there.
+*/
+
+var (
+	MemBudget   uint
+	MemPolicy   string
+	memUsed     int64 // updated by CircularMessageArray
+	nMemEvicted = expvar.NewInt("nMemEvicted")
+)
+
+func init() {
+	flag.UintVar(
+		&MemBudget, "mem-budget", 0,
+		"Max bytes of messages to hold across all channels (0 for no limit).",
+	)
+	flag.StringVar(
+		&MemPolicy, "mem-policy", "reject",
+		"What to do when mem-budget is full: reject or evict.",
+	)
+}
+
+// SetupMemory checks -mem-policy.
+func SetupMemory() error {
+	if MemPolicy != "reject" && MemPolicy != "evict" {
+		return errors.New("invalid mem-policy: " + MemPolicy)
+	}
+	return nil
+}
+
+// reserveMemory reserves n more bytes of the budget, the caller has to
+// releaseMemory them once done pushing. Must be called without holding any
+// channel lock.
+func reserveMemory(n uint) error {
+	if MemBudget == 0 {
+		return nil
+	}
+
+	for {
+		used := atomic.LoadInt64(&memUsed)
+		if uint(used)+n > MemBudget {
+			if MemPolicy != "evict" || !evictLargest() {
+				return ErrMemoryFull
+			}
+			continue
+		}
+		if atomic.CompareAndSwapInt64(&memUsed, used, used+int64(n)) {
+			return nil
+		}
+	}
+}
+
+// releaseMemory gives back n bytes reserved by reserveMemory.
+func releaseMemory(n uint) {
+	if MemBudget == 0 {
+		return
+	}
+	atomic.AddInt64(&memUsed, -int64(n))
+}
+
+// evictLargest drops the oldest message of the channel holding most bytes.
+// Returns false if there was nothing to drop.
+func evictLargest() bool {
+	var largest *Channel
+	most := uint(0)
+	eachChannel(func(ch *Channel) {
+		ch.lock.RLock()
+		if ch.Messages != nil && ch.Messages.Bytes() > most {
+			largest, most = ch, ch.Messages.Bytes()
+		}
+		ch.lock.RUnlock()
+	})
+	if largest == nil {
+		return false
+	}
+
+	largest.lock.Lock()
+	defer largest.lock.Unlock()
+
+	old, err := largest.Messages.Pop()
+	if err != nil {
+		return false
+	}
+	Persist(largest, nil, old)
+	largest.roomFreed()
+	nMemEvicted.Add(1)
+	infof("evicted message of %s, memory budget full", largest.Name)
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMemoryBudgetConcurrent(t *testing.T) {
+	defer func(budget uint, policy string) {
+		MemBudget, MemPolicy = budget, policy
+	}(MemBudget, MemPolicy)
+	MemBudget, MemPolicy = uint(atomic.LoadInt64(&memUsed))+100, "reject"
+
+	c := NewChannel(ChannelOptions{Size: 1000})
+	ok, full := int64(0), int64(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch _, err := c.Pub([]byte("0123456789")); err {
+			case nil:
+				atomic.AddInt64(&ok, 1)
+			case ErrMemoryFull:
+				atomic.AddInt64(&full, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok != 10 || full != 40 {
+		t.Fatalf("%d published, %d refused, want 10 and 40", ok, full)
+	}
+	if used := uint(atomic.LoadInt64(&memUsed)); used != MemBudget {
+		t.Fatalf("%d bytes used, budget is %d", used, MemBudget)
+	}
+	c.Empty()
+	if used := uint(atomic.LoadInt64(&memUsed)); used != MemBudget-100 {
+		t.Fatalf("%d bytes used after emptying, want %d", used, MemBudget-100)
+	}
+}
+
+func TestSetupMemory(t *testing.T) {
+	defer func(policy string) { MemPolicy = policy }(MemPolicy)
+	for policy, ok := range map[string]bool{
+		"reject": true, "evict": true, "": false, "drop": false,
+	} {
+		MemPolicy = policy
+		if err := SetupMemory(); (err == nil) != ok {
+			t.Errorf("SetupMemory with %q = %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	MetricsMaxChannels int
+)
+
+func init() {
+	flag.IntVar(
+		&MetricsMaxChannels, "metrics-max-channels", 1000,
+		"Above this many channels /metrics only has aggregate series.",
+	)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricsHandler serves channel and delivery stats in prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+
+		counter := func(name, help string, v int64) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+			fmt.Fprintf(&b, "%s %d\n", name, v)
+		}
+		counter(
+			"martd_messages_published_total", "Messages published.",
+			nPublished.Value(),
+		)
+		counter(
+			"martd_subscribes_total", "Subscriptions made.",
+			nSubscribed.Value(),
+		)
+		counter(
+			"martd_deliveries_total", "Messages delivered to clients.",
+			nDelivered.Value(),
+		)
+		counter(
+			"martd_dropped_deliveries_total",
+			"Messages dropped because the client was too slow.",
+			nDropped.Value(),
+		)
+
+		names := []string{}
+		chans := []*ChannelStats{}
+		sends, fanouts := []tally{}, []tally{}
+		eachChannel(func(ch *Channel) {
+			names = append(names, ch.Name)
+			chans = append(chans, ch.Stats())
+			sends = append(sends, ch.sendLatency.sums())
+			fanouts = append(fanouts, ch.fanoutTime.sums())
+		})
+
+		nSubscribers := 0
+		nMessages := uint(0)
+		for _, st := range chans {
+			nSubscribers += st.Subscribers
+			nMessages += st.Messages
+		}
+
+		gauge := func(name, help string) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		}
+		gauge("martd_channels_total", "Channels in memory.")
+		fmt.Fprintf(&b, "martd_channels_total %d\n", len(names))
+		gauge("martd_subscribers_total", "Clients waiting on all channels.")
+		fmt.Fprintf(&b, "martd_subscribers_total %d\n", nSubscribers)
+		gauge("martd_messages_total", "Messages buffered in all channels.")
+		fmt.Fprintf(&b, "martd_messages_total %d\n", nMessages)
+
+		summary := func(name, help string, tallies []tally, perChannel bool) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+			all := tally{}
+			for i, t := range tallies {
+				all.count += t.count
+				all.sum += t.sum
+				if perChannel {
+					label := labelEscaper.Replace(names[i])
+					fmt.Fprintf(
+						&b, "%s_sum{channel=\"%s\"} %g\n%s_count{channel=\"%s\"} %d\n",
+						name, label, t.sum.Seconds(), name, label, t.count,
+					)
+				}
+			}
+			fmt.Fprintf(
+				&b, "%s_sum %g\n%s_count %d\n",
+				name, all.sum.Seconds(), name, all.count,
+			)
+		}
+		perChannel := len(names) <= MetricsMaxChannels
+		summary(
+			"martd_send_latency_seconds",
+			"Time from a message being pushed to being sent to a client.",
+			sends, perChannel,
+		)
+		summary(
+			"martd_fanout_seconds",
+			"Time taken to send a message to all clients of the channel.",
+			fanouts, perChannel,
+		)
+
+		if len(names) <= MetricsMaxChannels {
+			gauge("martd_subscribers", "Clients waiting on the channel.")
+			for i, name := range names {
+				fmt.Fprintf(
+					&b, "martd_subscribers{channel=\"%s\"} %d\n",
+					labelEscaper.Replace(name), chans[i].Subscribers,
+				)
+			}
+			gauge("martd_messages", "Messages buffered in the channel.")
+			for i, name := range names {
+				fmt.Fprintf(
+					&b, "martd_messages{channel=\"%s\"} %d\n",
+					labelEscaper.Replace(name), chans[i].Messages,
+				)
+			}
+			gauge(
+				"martd_buffer_evictions",
+				"Pushes that dropped the oldest message of the channel.",
+			)
+			for i, name := range names {
+				fmt.Fprintf(
+					&b, "martd_buffer_evictions{channel=\"%s\"} %d\n",
+					labelEscaper.Replace(name), chans[i].Evictions,
+				)
+			}
+			gauge("martd_buffer_high_water", "Most messages the channel held.")
+			for i, name := range names {
+				fmt.Fprintf(
+					&b, "martd_buffer_high_water{channel=\"%s\"} %d\n",
+					labelEscaper.Replace(name), chans[i].HighWater,
+				)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(b.Bytes())
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import "sort"
+
+/*
+	Read your writes: a client that pushed, and then subscribes, passes the
+	etag its push got as SubOptions.MinEtag, and is not answered till the
+	channel has had a push with at least that etag, so it is sure to see
+	its own message, even one Pub is still holding back, see coalesce.go.
+	It is then answered as any subscriber, with what came after the etag it
+	subscribed with. If the message has dropped out of the buffer since,
+	newer ones have been pushed, so the subscriber is answered right away,
+	with Lost set if its own etag is gone too. A channel that was deleted
+	since, and made again, only counts pushes from then on, a held back
+	push that was dropped counts as pushed. One2one and stream subscribers
+	ignore MinEtag.
+*/
+
+// reached tells if c has had a push with an etag of at least min. Must be
+// called with c.lock held.
+func (c *Channel) reached(min int64) bool {
+	if min <= 0 || c.One2One {
+		return true
+	}
+	// lastEtag may be that of the push Pub is holding back
+	return c.lastEtag >= min && (c.held == nil || c.held.Created != min)
+}
+
+// minEtagEvent is what a one shot subscriber that wants a MinEtag gets
+// instead of ev: nil till c has reached it, then everything after the etag
+// it subscribed with, because ev alone may leave out messages it skipped
+// while waiting. Must be called with c.lock held.
+func (c *Channel) minEtagEvent(ev *ChannelEvent, sub *Subscriber) *ChannelEvent {
+	if sub.min <= 0 || sub.stream || c.One2One || ev.Mesg == nil {
+		return ev
+	}
+	if !c.reached(sub.min) {
+		return nil
+	}
+
+	msgs := c.urgentAfter(sub.from)
+	c.Messages.ForEach(c.Messages.IndexAfter(sub.from), func(m *Message) bool {
+		msgs = append(msgs, m)
+		return true
+	})
+	if len(msgs) == 0 {
+		return ev
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created < msgs[j].Created
+	})
+	return &ChannelEvent{Chan: c, Mesg: msgs[len(msgs)-1], Batch: msgs}
+}
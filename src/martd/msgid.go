@@ -0,0 +1,120 @@
+package main
+
+import "errors"
+
+/*
+	Publishers can give messages an id of their own, it goes along with the
+	message to subscribers, in the ids of the channel response, lined up
+	with payload. A message published again with an id still in the channel
+	is dropped, so producers can retry safely, the channel's messages are
+	the dedup window. Messages without an id are never deduplicated, and
+	responses only have ids if one of their messages has one.
+*/
+
+// errDuplicateID is push finding a message with the id, once it has waited
+// for room, see full.go.
+var errDuplicateID = errors.New("message with id published meanwhile")
+
+// PubWithID is Pub, with id attached to the message. If a message with id
+// is still in the channel nothing is published, and its etag is returned
+// with dup set.
+func (c *Channel) PubWithID(
+	data []byte, id string,
+) (etag int64, dup bool, err error) {
+	if id == "" {
+		etag, err = c.Pub(data)
+		return etag, false, err
+	}
+	return c.pubMessage(data, id, nil)
+}
+
+// pubMessage is PubWithID with headers, id may be "" for no id.
+func (c *Channel) pubMessage(
+	data []byte, id string, headers map[string]string,
+) (etag int64, dup bool, err error) {
+	opts := c.options()
+	if err := opts.check(data); err != nil {
+		return 0, false, err
+	}
+	if !c.limiter.allow(1, opts.Rate, opts.Burst) {
+		return 0, false, ErrRateLimited
+	}
+
+	// has to happen before we lock c, it may lock other channels
+	if err := reserveMemory(uint(len(data))); err != nil {
+		return 0, false, err
+	}
+	defer releaseMemory(uint(len(data)))
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	if id != "" {
+		if m := c.messageWithID(id); m != nil {
+			return m.Created, true, nil
+		}
+	}
+
+	m, old, err := c.push(data, 0, id, headers, false)
+	if err == errDuplicateID {
+		return c.messageWithID(id).Created, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if c.One2One {
+		c.pubOne(m, old)
+		return m.Created, false, nil
+	}
+
+	Persist(c, m, old)
+	c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(data)})
+	return m.Created, false, nil
+}
+
+// messageWithID finds the message with id in either lane, nil if there is
+// none. Must be called with c.lock held.
+func (c *Channel) messageWithID(id string) *Message {
+	var found *Message
+	find := func(m *Message) bool {
+		if m.ID == id {
+			found = m
+		}
+		return found == nil
+	}
+	if c.Messages != nil {
+		c.Messages.ForEach(0, find)
+	}
+	if found == nil && c.urgent != nil {
+		c.urgent.ForEach(0, find)
+	}
+	return found
+}
+
+// add appends m, data being its payload, to r.
+func (r *ChanResponse) add(c *Channel, m *Message, data []byte) {
+	if m.ID != "" && r.IDs == nil {
+		r.IDs = make([]string, len(r.Payload))
+	}
+	if m.Headers != nil && r.Headers == nil {
+		r.Headers = make([]map[string]string, len(r.Payload))
+	}
+	r.Payload = append(r.Payload, c.encode(data))
+	r.etags = append(r.etags, m.Created)
+	r.msgs = append(r.msgs, m)
+	if r.IDs != nil {
+		r.IDs = append(r.IDs, m.ID)
+	}
+	if r.Headers != nil {
+		r.Headers = append(r.Headers, m.Headers)
+	}
+}
+
+// ids returns r.IDs, or as many empty ids as r has messages.
+func (r *ChanResponse) ids() []string {
+	if r.IDs != nil {
+		return r.IDs
+	}
+	return make([]string, len(r.Payload))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+/*
+	Channel names can have a namespace, the part before the first ":", so
+	"tenantA:orders" is the channel "orders" of namespace "tenantA". A
+	namespace can have a key, then that key is needed to create, publish to
+	or subscribe to any channel in it, and channels in it have no keys of
+	their own. Keys come from -namespace-keys, a json object of namespace to
+	key, or SetNamespaceKey. Channels outside keyed namespaces keep their
+	own keys, as before.
+*/
+
+var (
+	NamespaceKeysFile string
+	namespaceKeys     = make(map[string]string)
+	namespaceLock     sync.RWMutex
+)
+
+func init() {
+	flag.StringVar(
+		&NamespaceKeysFile, "namespace-keys", "",
+		`Json file of namespace keys, like {"tenantA": "secret"}.`,
+	)
+}
+
+// LoadNamespaceKeys reads -namespace-keys, if set.
+func LoadNamespaceKeys() error {
+	if NamespaceKeysFile == "" {
+		return nil
+	}
+	j, err := ioutil.ReadFile(NamespaceKeysFile)
+	if err != nil {
+		return err
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(j, &keys); err != nil {
+		return err
+	}
+	for ns, key := range keys {
+		SetNamespaceKey(ns, key)
+	}
+	return nil
+}
+
+// SetNamespaceKey sets the key of namespace ns, "" makes it open again.
+func SetNamespaceKey(ns, key string) {
+	namespaceLock.Lock()
+	defer namespaceLock.Unlock()
+
+	if key == "" {
+		delete(namespaceKeys, ns)
+		return
+	}
+	namespaceKeys[ns] = key
+}
+
+// Namespace returns the namespace of channel name, "" if it has none.
+func Namespace(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// namespaceKey returns the key of the namespace of channel name, "" if
+// there is none.
+func namespaceKey(name string) string {
+	ns := Namespace(name)
+	if ns == "" {
+		return ""
+	}
+
+	namespaceLock.RLock()
+	defer namespaceLock.RUnlock()
+	return namespaceKeys[ns]
+}
+
+// namespaced checks the key in opts against the namespace of channel name,
+// and takes it out of opts if it is the namespace's: the channel is guarded
+// by the namespace key from then on.
+func namespaced(name string, opts ChannelOptions) (ChannelOptions, error) {
+	nsKey := namespaceKey(name)
+	if nsKey == "" {
+		return opts, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(nsKey), []byte(opts.Key)) != 1 {
+		warnf("bad namespace key for %s", name)
+		return opts, ErrBadKey
+	}
+	opts.Key = ""
+	return opts, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+	/sub and /recent answer with one json object by default. With
+	format=ndjson, or an Accept header asking for application/x-ndjson,
+	they answer with one json object per line instead, one for each
+	message, with its channel and etag, so clients can handle messages as
+	they read them. A channel whose etag moved past its last message, or
+	that has nothing to send, or is lost, drained or has more, gets a line
+	without data saying so. Errors are a line with just error. Blank lines,
+	from keepalives, are to be skipped.
+*/
+
+type ndjsonLine struct {
+	Channel  string            `json:"channel,omitempty"`
+	Etag     string            `json:"etag,omitempty"`
+	Data     *string           `json:"data,omitempty"` // nil on etag only lines
+	ID       string            `json:"id,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Encoding string            `json:"encoding,omitempty"`
+	Lost     bool              `json:"lost,omitempty"`
+	Drained  bool              `json:"drained,omitempty"`
+	More     bool              `json:"more,omitempty"`
+	Count    int               `json:"count,omitempty"` // with count_only
+	Error    string            `json:"error,omitempty"`
+}
+
+// wantsNDJSON tells if the client asked for ndjson.
+func wantsNDJSON(r *http.Request) bool {
+	if r.FormValue("format") == "ndjson" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/x-ndjson") ||
+		strings.Contains(accept, "application/ndjson")
+}
+
+// lines turns resp into ndjson lines, channels sorted by name.
+func (resp *SubResponse) lines() []*ndjsonLine {
+	if resp.Error != "" {
+		return []*ndjsonLine{{Error: resp.Error}}
+	}
+
+	names := make([]string, 0, len(resp.Channels))
+	for name := range resp.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []*ndjsonLine{}
+	for _, name := range names {
+		cr := resp.Channels[name]
+		last := ""
+		for i := range cr.Payload {
+			l := &ndjsonLine{
+				Channel: name, Etag: cr.Etag, Data: &cr.Payload[i],
+				Encoding: cr.Encoding,
+			}
+			if i < len(cr.etags) {
+				l.Etag = fmt.Sprintf("%d", cr.etags[i])
+			}
+			if i < len(cr.IDs) {
+				l.ID = cr.IDs[i]
+			}
+			if i < len(cr.Headers) {
+				l.Headers = cr.Headers[i]
+			}
+			lines = append(lines, l)
+			last = l.Etag
+		}
+		if last != cr.Etag || cr.Lost || cr.Drained || cr.More {
+			lines = append(lines, &ndjsonLine{
+				Channel: name, Etag: cr.Etag, Lost: cr.Lost,
+				Drained: cr.Drained, More: cr.More, Count: cr.Count,
+			})
+		}
+	}
+	return lines
+}
+
+// respondNDJSON is respond, in ndjson.
+func respondNDJSON(w http.ResponseWriter, resp *SubResponse, gz bool) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, l := range resp.lines() {
+		if err := enc.Encode(l); err != nil {
+			log.Println("Error during json.Marshal", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	writeBody(w, b.Bytes(), gz)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+/*
+	Pattern subscriptions wait on every channel whose name matches a glob.
+	Names are split on "/", "*" matches exactly one segment and "**" any
+	number of segments, including none. So "user/*" matches "user/1" but
+	not "user/1/inbox", "user/**" matches both, and "user" too. Stars
+	only ever stand for whole segments, "user/1*" is not a pattern. As each
+	"**" multiplies the work of matching, a pattern can have at most
+	MaxDoubleStars of them, two in a row count as one.
+
+	Pattern subscriptions only ever get new messages, there is no backlog,
+	as etags are per channel.
+*/
+
+type PatternSub struct {
+	Pattern string
+	evch    chan *ChannelEvent
+	key     string
+}
+
+var (
+	PatternSubs    = make(map[*PatternSub]bool)
+	PatternLock    sync.RWMutex // for PatternSubs
+	MaxDoubleStars = 4
+)
+
+// MatchPattern tells if channel name matches pattern.
+func MatchPattern(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 1 && pattern[1] == "**" {
+				pattern = pattern[1:] // same as one, without the extra work
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if pattern[0] != "*" && pattern[0] != name[0] {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func ValidatePattern(pattern string) error {
+	stars, last := 0, ""
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg == "**" && last != "**" {
+			stars++
+		}
+		if seg != "*" && seg != "**" && strings.Contains(seg, "*") {
+			return ErrBadPattern
+		}
+		last = seg
+	}
+	if stars > MaxDoubleStars {
+		return ErrTooManyStars
+	}
+	return ValidateChannelName(strings.Replace(pattern, "*", "x", -1))
+}
+
+// SubPattern subscribes evch to every channel matching pattern that key
+// opens, and to any such channel created later on, till UnSubPattern.
+// Channels that have MaxSubscribers already are skipped.
+func SubPattern(pattern, key string, evch chan *ChannelEvent) *PatternSub {
+	PatternLock.Lock()
+	defer PatternLock.Unlock()
+
+	ps := &PatternSub{Pattern: pattern, evch: evch, key: key}
+	PatternSubs[ps] = true
+
+	eachChannel(func(ch *Channel) {
+		if MatchPattern(pattern, ch.Name) && ch.CheckKey(key) == nil {
+			ch.Sub(evch)
+		}
+	})
+	return ps
+}
+
+func UnSubPattern(ps *PatternSub) {
+	PatternLock.Lock()
+	defer PatternLock.Unlock()
+
+	delete(PatternSubs, ps)
+
+	eachChannel(func(ch *Channel) {
+		if MatchPattern(ps.Pattern, ch.Name) {
+			ch.UnSub(ps.evch)
+		}
+	})
+}
+
+// subPatterns subscribes a just created channel to the patterns it matches.
+// Must be called with PatternLock held.
+func (c *Channel) subPatterns() {
+	var matched []*PatternSub
+	c.lock.RLock()
+	for ps := range PatternSubs {
+		if MatchPattern(ps.Pattern, c.Name) && c.CheckKey(ps.key) == nil {
+			matched = append(matched, ps)
+		}
+	}
+	c.lock.RUnlock()
+
+	for _, ps := range matched {
+		c.Sub(ps.evch)
+	}
+}
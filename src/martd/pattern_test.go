@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"user/*", "user/1", true},
+		{"user/*", "user/1/inbox", false},
+		{"user/*", "user", false},
+		{"user/**", "user", true},
+		{"user/**", "user/1/inbox", true},
+		{"user/**/inbox", "user/inbox", true},
+		{"user/**/inbox", "user/1/2/inbox", true},
+		{"user/**/inbox", "user/1/outbox", false},
+		{"user/**/**/inbox", "user/1/inbox", true},
+		{"**/**/**/x", "a/b/c/d/e/f/g/h/y", false},
+	}
+	for _, tc := range cases {
+		if got := MatchPattern(tc.pattern, tc.name); got != tc.match {
+			t.Errorf("MatchPattern(%q, %q) = %v", tc.pattern, tc.name, got)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	cases := map[string]error{
+		"user/*":                 nil,
+		"user/**/inbox":          nil,
+		"**/**/**/**/**":         nil,
+		"user/1*":                ErrBadPattern,
+		"user/*x/inbox":          ErrBadPattern,
+		"user/***":               ErrBadPattern,
+		"**/a/**/b/**/c/**/d/**": ErrTooManyStars,
+		"user/*/in box":          ErrBadChannelName,
+	}
+	for pattern, want := range cases {
+		if err := ValidatePattern(pattern); err != want {
+			t.Errorf("ValidatePattern(%q) = %v, want %v", pattern, err, want)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	With -peers, martd nodes form a simple cluster, each channel owned by
+	one of them, see ChannelOwner. A push to /pub of a channel owned by
+	another node is forwarded there, and the owner's answer is passed back.
+	A node with subscribers on a channel owned elsewhere relays it: it
+	subscribes to the owner over the usual /sub, and publishes what comes
+	into its own copy of the channel, with the owner's etags, so its
+	subscribers get it as if it was pushed there. Relays keep going for
+	-peer-linger after the last subscriber leaves, as long polling clients
+	leave after every message.
+
+	Requests from peers carry X-Martd-Peer, and are never forwarded or
+	relayed again, so nodes that do not agree on -peers do not send
+	requests round in circles. With -peer-key relays get into channels
+	with keys too, peers take that key in place of any channel's key, and
+	X-Martd-Peer only counts along with it. With -tls-cert nodes talk to
+	each other with the same certificate, trusting -tls-client-ca, so
+	they get past each other's mTLS.
+	Only /pub and /sub go to the owner, /recent, /stats and the like show
+	a node's own copy, which only has what was relayed, with default
+	attributes.
+*/
+
+const (
+	peerHeader    = "X-Martd-Peer"
+	peerKeyHeader = "X-Martd-Peer-Key"
+)
+
+var (
+	Peers      string
+	NodeName   string
+	PeerKey    string
+	PeerLinger time.Duration
+	peers      []string
+	relays     = make(map[string]*relay)
+	relaysLock sync.Mutex
+	peerClient = &http.Client{}
+	nForwarded = expvar.NewInt("nForwarded")
+	nRelayed   = expvar.NewInt("nRelayed")
+)
+
+func init() {
+	flag.StringVar(
+		&Peers, "peers", "",
+		"Comma separated urls of all nodes of the cluster, this one too.",
+	)
+	flag.StringVar(&NodeName, "node", "", "Which of -peers this node is.")
+	flag.StringVar(
+		&PeerKey, "peer-key", "",
+		"Key peers use in place of channel keys, for relaying them.",
+	)
+	flag.DurationVar(
+		&PeerLinger, "peer-linger", 30*time.Second,
+		"How long to keep relaying a channel with no subscribers.",
+	)
+}
+
+type relay struct {
+	cancel func()
+	stop   *time.Timer // pending stop, nil if it has subscribers
+}
+
+// SetupPeers reads -peers, and starts relaying channels owned by other
+// nodes as they get subscribers.
+func SetupPeers() error {
+	if Peers == "" {
+		return nil
+	}
+	found := false
+	for _, p := range strings.Split(Peers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+			found = found || p == NodeName
+		}
+	}
+	if !found {
+		return errors.New("-node must be one of -peers")
+	}
+	config, err := TLSConfig()
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		peerClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: config.Certificates, RootCAs: config.ClientCAs,
+			},
+		}
+	}
+
+	OnFirstSubscriber(startRelay)
+	OnLastUnsubscribe(lingerRelay)
+	OnChannelDelete(stopRelay)
+	return nil
+}
+
+// remoteOwner returns the node that owns channel name, and if it is not
+// this one.
+func remoteOwner(name string) (string, bool) {
+	if len(peers) == 0 {
+		return "", false
+	}
+	owner := ChannelOwner(name, peers)
+	return owner, owner != NodeName
+}
+
+func peerURL(node, path string) string {
+	if !strings.Contains(node, "://") {
+		node = "http://" + node
+	}
+	return strings.TrimSuffix(node, "/") + path
+}
+
+// fromPeer tells if r comes from another node. Anyone can send the header,
+// with -peer-key only those that know it are peers.
+func fromPeer(r *http.Request) bool {
+	return r.Header.Get(peerHeader) != "" && (PeerKey == "" || peerTrusted(r))
+}
+
+// peerTrusted tells if r comes from a peer that knows -peer-key.
+func peerTrusted(r *http.Request) bool {
+	key := r.Header.Get(peerKeyHeader)
+	return PeerKey != "" &&
+		subtle.ConstantTimeCompare([]byte(PeerKey), []byte(key)) == 1
+}
+
+func peerRequest(
+	ctx context.Context, method, url string, body io.Reader,
+) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHeader, NodeName)
+	if PeerKey != "" {
+		req.Header.Set(peerKeyHeader, PeerKey)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// forwardPub sends a push of channel to its owner, if that is another
+// node, and answers with what the owner said. It tells if it did. A push
+// that came in a form goes on as a raw body, with the fields in the query.
+func forwardPub(
+	w http.ResponseWriter, r *http.Request, channel string, body []byte,
+	form bool,
+) bool {
+	owner, remote := remoteOwner(channel)
+	if !remote || fromPeer(r) {
+		return false
+	}
+
+	query, ct := r.URL.RawQuery, r.Header.Get("Content-Type")
+	if form {
+		query, ct = formQuery(r), "application/octet-stream"
+	}
+	req, err := peerRequest(
+		r.Context(), "POST", peerURL(owner, "/pub?"+query),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		reject(w, err.Error())
+		return true
+	}
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		rejectStatus(
+			w, "could not reach "+owner+": "+err.Error(), http.StatusBadGateway,
+		)
+		return true
+	}
+	defer resp.Body.Close()
+
+	nForwarded.Add(1)
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// startRelay starts relaying c from its owner, if that is another node,
+// or keeps the relay going if it was about to stop.
+func startRelay(c *Channel) {
+	owner, remote := remoteOwner(c.Name)
+	if !remote || c.detached {
+		return
+	}
+
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	if r := relays[c.Name]; r != nil {
+		if r.stop != nil {
+			r.stop.Stop()
+			r.stop = nil
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	relays[c.Name] = &relay{cancel: cancel}
+	infof("relaying %s from %s", c.Name, owner)
+	go c.relay(ctx, owner)
+}
+
+// lingerRelay stops relaying c in -peer-linger, unless it gets
+// subscribers again.
+func lingerRelay(c *Channel) {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	r := relays[c.Name]
+	if r == nil || r.stop != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(PeerLinger, func() {
+		relaysLock.Lock()
+		defer relaysLock.Unlock()
+
+		if relays[c.Name] != r || r.stop != t {
+			return // got subscribers again
+		}
+		c.lock.RLock()
+		idle := len(c.Clients) == 0
+		c.lock.RUnlock()
+		if !idle {
+			r.stop = nil
+			return
+		}
+		r.cancel()
+		delete(relays, c.Name)
+		infof("stopped relaying %s", c.Name)
+	})
+	r.stop = t
+}
+
+func stopRelay(name string) {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	if r := relays[name]; r != nil {
+		if r.stop != nil {
+			r.stop.Stop()
+		}
+		r.cancel()
+		delete(relays, name)
+	}
+}
+
+// relay subscribes to c on owner till ctx is done, and publishes what it
+// gets into c.
+func (c *Channel) relay(ctx context.Context, owner string) {
+	for ctx.Err() == nil {
+		c.lock.RLock()
+		etag := c.lastEtag
+		c.lock.RUnlock()
+
+		lines, err := peerSub(ctx, owner, c.Name, etag)
+		if err == nil {
+			err = c.mirror(lines)
+		}
+		if err != nil && ctx.Err() == nil {
+			warnf("could not relay %s from %s: %s", c.Name, owner, err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// peerSub long polls channel name on node, from etag, and returns the
+// ndjson lines it answers with.
+func peerSub(
+	ctx context.Context, node, name string, etag int64,
+) ([]*ndjsonLine, error) {
+	q := url.Values{}
+	q.Set(name, fmt.Sprintf("%d", etag))
+	q.Set("format", "ndjson")
+	q.Set("heartbeat", "30s")
+	req, err := peerRequest(ctx, "GET", peerURL(node, "/sub?"+q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	lines := []*ndjsonLine{}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		l := &ndjsonLine{}
+		if err := dec.Decode(l); err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if l.Error != "" {
+			return nil, errors.New(l.Error)
+		}
+		lines = append(lines, l)
+	}
+}
+
+// mirror publishes the messages of lines newer than what c has, with their
+// etags.
+func (c *Channel) mirror(lines []*ndjsonLine) error {
+	type relayed struct {
+		data []byte
+		line *ndjsonLine
+		etag int64
+	}
+	msgs := []relayed{}
+	size := uint(0)
+	for _, l := range lines {
+		if l.Data == nil {
+			continue
+		}
+		m := relayed{data: []byte(*l.Data), line: l}
+		if _, err := fmt.Sscan(l.Etag, &m.etag); err != nil {
+			return errors.New("invalid etag: " + l.Etag)
+		}
+		if l.Encoding == "base64" {
+			data, err := base64.StdEncoding.DecodeString(*l.Data)
+			if err != nil {
+				return err
+			}
+			m.data = data
+		}
+		msgs = append(msgs, m)
+		size += uint(len(m.data))
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	// subscribers may be waiting on a channel no one has pushed to here
+	if ch, _, err := getOrCreateChannel(c.Name, ChannelOptions{}); err != nil {
+		return err
+	} else if ch != c {
+		return ErrChannelNotFound // deleted since, stopRelay is coming
+	}
+
+	// has to happen before we lock c, it may lock other channels
+	if err := reserveMemory(size); err != nil {
+		return err
+	}
+	defer releaseMemory(size)
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	c.relayed = true
+	for _, r := range msgs {
+		if r.etag <= c.lastEtag {
+			continue // got it already
+		}
+		m, old, err := c.push(r.data, r.etag, r.line.ID, r.line.Headers, false)
+		if err != nil {
+			return err
+		}
+		nRelayed.Add(1)
+		Persist(c, m, old)
+		c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(r.data)})
+	}
+	return nil
+}
+
+// relayedEvent leaves out of ev what a one shot subscriber of a relayed
+// channel has seen already. The relay may catch up with the owner after
+// the client subscribed, publishing messages older than its etag. Must be
+// called with c.lock held.
+func (c *Channel) relayedEvent(ev *ChannelEvent, sub *Subscriber) *ChannelEvent {
+	if !c.relayed || sub.stream || ev.Mesg == nil {
+		return ev
+	}
+	msgs := []*Message{}
+	for _, m := range ev.Messages() {
+		if m.Created > sub.from {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if len(msgs) == len(ev.Messages()) {
+		return ev
+	}
+	return &ChannelEvent{Chan: c, Mesg: msgs[len(msgs)-1], Batch: msgs}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromPeer(t *testing.T) {
+	defer func(key string) { PeerKey = key }(PeerKey)
+	cases := []struct {
+		peerKey, header, key string
+		peer                 bool
+	}{
+		{"", "", "", false},
+		{"", "b", "", true},
+		{"s3", "b", "", false},
+		{"s3", "b", "wrong", false},
+		{"s3", "b", "s3", true},
+		{"s3", "", "s3", false},
+	}
+	for _, tc := range cases {
+		PeerKey = tc.peerKey
+		r := httptest.NewRequest("POST", "/pub?channel=foo", nil)
+		if tc.header != "" {
+			r.Header.Set(peerHeader, tc.header)
+		}
+		if tc.key != "" {
+			r.Header.Set(peerKeyHeader, tc.key)
+		}
+		if got := fromPeer(r); got != tc.peer {
+			t.Errorf("%+v: fromPeer = %v", tc, got)
+		}
+	}
+}
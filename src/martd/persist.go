@@ -2,21 +2,23 @@ package main
 
 import (
 	"database/sql"
-	"log"
-	_ "github.com/mattn/go-sqlite3"
+	"encoding/json"
 	"flag"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"math"
 	"time"
 )
 
 var (
-	PersistChan chan *DMessage
+	// made here, not in init, channels.go's init starts sending on it
+	PersistChan = make(chan *DMessage)
 	PersistFile string
 	PersistDB   *sql.DB
 )
 
 func init() {
 	flag.StringVar(&PersistFile, "persist", "persist.db", "Persist File")
-	PersistChan = make(chan *DMessage)
 }
 
 type DMessage struct {
@@ -24,11 +26,18 @@ type DMessage struct {
 	m, old *Message
 }
 
+// Persist stores m and deletes old, either can be nil.
 func Persist(c *Channel, m, old *Message) {
+	if c.detached {
+		return
+	}
 	PersistChan <- &DMessage{c, m, old}
 }
 
 func EmptyChannel(c *Channel) {
+	if c.detached {
+		return
+	}
 	PersistChan <- &DMessage{c, nil, nil}
 }
 
@@ -56,7 +65,7 @@ func InsertPayload(dm *DMessage) {
 		}
 		defer stmt.Close()
 
-		now := time.Now().UnixNano()
+		now := Clock()
 		rows, err := stmt.Query(now)
 		if err != nil {
 			log.Fatal(err)
@@ -67,8 +76,9 @@ func InsertPayload(dm *DMessage) {
 			var channel string
 			rows.Scan(&channel)
 			log.Println(channel, "has expired messages")
-			ch := GetChannel(channel)
-			ch.ExpireOldMessages(now)
+			if ch := existingChannel(channel); ch != nil {
+				ch.ExpireOldMessages(now)
+			}
 		}
 
 		stmt, err = tx.Prepare("delete from payloads where expiry < ?")
@@ -115,7 +125,7 @@ func InsertPayload(dm *DMessage) {
 		return
 	}
 
-	if dm.m == nil {
+	if dm.m == nil && dm.old == nil {
 		stmt, err := tx.Prepare("delete from payloads where channel = ?")
 		if err != nil {
 			log.Fatal(err)
@@ -130,46 +140,73 @@ func InsertPayload(dm *DMessage) {
 		return
 	}
 
+	if dm.m != nil {
+		InsertMessage(tx, dm)
+	}
+
+	if dm.old != nil {
+		stmt, err := tx.Prepare("delete from payloads where id = ?")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stmt.Close()
+
+		_, err = stmt.Exec(dm.old.Created)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func InsertMessage(tx *sql.Tx, dm *DMessage) {
 	stmt, err := tx.Prepare(
 		`insert into payloads(
-			id, channel, expiry, size, life, one2one, key, payload
-		) values (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, channel, expiry, size, life, one2one, key, payload, options,
+			message_id, headers
+		) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(
-		dm.m.Created, dm.c.Name, dm.m.Created + int64(dm.c.Life), dm.c.Size,
-		dm.c.Life, dm.c.One2One, dm.c.Key, dm.m.Data,
-	)
+	options, err := json.Marshal(dm.c.ChannelOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if dm.old != nil {
-		stmt, err := tx.Prepare("delete from payloads where id = ?")
-		if err != nil {
+	headers := []byte{}
+	if dm.m.Headers != nil {
+		if headers, err = json.Marshal(dm.m.Headers); err != nil {
 			log.Fatal(err)
 		}
-		defer stmt.Close()
+	}
 
-		_, err = stmt.Exec(dm.old.Created)
-		if err != nil {
-			log.Fatal(err)
-		}
+	expiry := int64(math.MaxInt64) // life of 0 means never expire
+	if dm.c.Life != 0 {
+		expiry = dm.m.Created + int64(dm.c.Life)
+	}
+
+	_, err = stmt.Exec(
+		dm.m.Created, dm.c.Name, expiry, dm.c.Size,
+		dm.c.Life, dm.c.One2One, dm.c.Key, dm.m.Payload(), string(options),
+		dm.m.ID, string(headers),
+	)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
-func Persister() {
+// OpenPersistDB opens PersistFile for Persister.
+func OpenPersistDB() error {
 	var err error
 	PersistDB, err = GetDB()
-	if err != nil {
-		log.Panicln("Could not open DB", err)
-	}
+	return err
+}
+
+func Persister() {
 	for {
-		dm := <- PersistChan
+		dm := <-PersistChan
 		InsertPayload(dm)
 	}
 }
@@ -191,7 +228,10 @@ func GetDB() (*sql.DB, error) {
 			life    integer, -- number of seconds
 			one2one integer,
 			key     text,
-			payload blob
+			payload blob,
+			options text, -- ChannelOptions as json
+			message_id text, -- given by the publisher
+			headers text -- of the message as json, if any
 		);
 	`
 	_, err = db.Exec(sqlStmt)
@@ -201,6 +241,11 @@ func GetDB() (*sql.DB, error) {
 		log.Println("Table created.")
 	}
 
+	// db created by older versions
+	db.Exec("alter table payloads add column options text")
+	db.Exec("alter table payloads add column message_id text")
+	db.Exec("alter table payloads add column headers text")
+
 	return db, nil
 }
 
@@ -212,22 +257,23 @@ func ReadChannels() error {
 	}
 	defer db.Close()
 
-
 	stmt, err := db.Prepare("delete from payloads where expiry < ?")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(time.Now().UnixNano())
+	_, err = stmt.Exec(Clock())
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	rows, err := db.Query(
 		`select
-			id, channel, expiry, size, life, one2one, key, payload
-		from payloads`,
+			id, channel, expiry, size, life, one2one, key, payload,
+			coalesce(options, ''), coalesce(message_id, ''),
+			coalesce(headers, '')
+		from payloads order by id`,
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -243,21 +289,38 @@ func ReadChannels() error {
 		var one2one bool
 		var key string
 		var payload []byte
+		var options string
+		var messageID string
+		var headers string
 		rows.Scan(
 			&id, &channel, &expiry, &size, &life, &one2one, &key, &payload,
+			&options, &messageID, &headers,
 		)
 		log.Println(
 			channel, expiry, size, life, one2one, key, id, string(payload),
 		)
-		ch, err := GetOrCreateChannel(
-			channel, size, time.Duration(life), one2one, key,
-		)
+		opts := ChannelOptions{
+			Size: size, Life: time.Duration(life), One2One: one2one, Key: key,
+		}
+		if options != "" {
+			if err := json.Unmarshal([]byte(options), &opts); err != nil {
+				log.Println("Bad options for channel:", channel, err)
+			}
+		}
+		ch, _, err := getOrCreateChannel(channel, opts)
 		if err != nil {
-			log.Fatalln("Error loading channel:", err)
+			log.Println("Error loading channel:", channel, err)
+			continue
 		}
 		log.Println(ch)
-		m := &Message{Data: payload, Created: id}
+		m := &Message{Data: payload, Created: id, ID: messageID}
+		if headers != "" {
+			if err := json.Unmarshal([]byte(headers), &m.Headers); err != nil {
+				log.Println("Bad headers for message:", channel, id, err)
+			}
+		}
 		ch.Messages.Push(m)
+		ch.lastEtag = id
 	}
 
 	return nil
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+	Messages published with a priority go to a separate, urgent, lane of
+	the channel, and Poll puts them ahead of the normal ones in the payload,
+	however much later they came. Etags come from the same sequence for both
+	lanes, so they still only ever go up, and the etag of a response is the
+	newest of all messages in it. Only the payload order differs: urgent
+	messages first, oldest first, then the normal ones, oldest first.
+
+	Subscribers waiting on the channel get urgent messages right away, like
+	any other. One2one channels have no urgent lane, priority is ignored
+	there. Messages restored from a snapshot keep their lane, those read
+	back from the db or the wal at startup all go to the normal lane.
+*/
+
+// PubPriority is Pub, messages with priority > 0 go to the urgent lane.
+func (c *Channel) PubPriority(data []byte, priority int) (int64, error) {
+	opts := c.options()
+	if priority <= 0 || opts.One2One {
+		return c.Pub(data)
+	}
+
+	if err := opts.check(data); err != nil {
+		return 0, err
+	}
+	if !c.limiter.allow(1, opts.Rate, opts.Burst) {
+		return 0, ErrRateLimited
+	}
+
+	// has to happen before we lock c, it may lock other channels
+	if err := reserveMemory(uint(len(data))); err != nil {
+		return 0, err
+	}
+	defer releaseMemory(uint(len(data)))
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	m, old, err := c.push(data, 0, "", nil, true)
+	if err != nil {
+		return 0, err
+	}
+
+	Persist(c, m, old)
+	c.fanout(&ChannelEvent{Chan: c, Mesg: m.plain(data)})
+	return m.Created, nil
+}
+
+// sinceEtag is hasNew, except etag may be that of an urgent message, then
+// all normal messages newer than it are new. Must be called with c.lock
+// held.
+func (c *Channel) sinceEtag(etag int64) (has bool, ith uint, lostData bool) {
+	if c.urgent != nil && etag != 0 {
+		if _, ok := c.urgent.IndexOfEtag(etag); ok {
+			ith := c.Messages.IndexAfter(etag)
+			return ith < c.Messages.Length(), ith, false
+		}
+	}
+	return c.hasNew(etag)
+}
+
+// urgentAfter returns urgent messages newer than etag. Must be called with
+// c.lock held.
+func (c *Channel) urgentAfter(etag int64) []*Message {
+	if c.urgent == nil || c.One2One {
+		return nil
+	}
+	urgent := []*Message{}
+	c.urgent.ForEach(c.urgent.IndexAfter(etag), func(m *Message) bool {
+		urgent = append(urgent, m)
+		return true
+	})
+	return urgent
+}
+
+// urgentBefore returns those of urgent created up to etag.
+func urgentBefore(urgent []*Message, etag string) []*Message {
+	upto := int64(0)
+	fmt.Sscan(etag, &upto)
+	i := 0
+	for i < len(urgent) && urgent[i].Created <= upto {
+		i++
+	}
+	return urgent[:i]
+}
+
+// prependUrgent puts urgent messages that match filter, and were created
+// since, ahead of the ones in resp, and moves its etag up to the newest of
+// them.
+func (c *Channel) prependUrgent(
+	resp *ChanResponse, urgent []*Message, filter Filter, since int64,
+) {
+	if len(urgent) == 0 {
+		return
+	}
+
+	front := &ChanResponse{Payload: []string{}}
+	for _, m := range urgent {
+		if m.Created < since {
+			continue
+		}
+		if data := m.Payload(); filter.Match(data) {
+			front.add(c, m, data)
+			m.handed()
+		}
+	}
+	if front.IDs != nil || resp.IDs != nil {
+		resp.IDs = append(front.ids(), resp.ids()...)
+	}
+	if front.Headers != nil || resp.Headers != nil {
+		resp.Headers = append(front.headers(), resp.headers()...)
+	}
+	resp.Payload = append(front.Payload, resp.Payload...)
+	resp.etags = append(front.etags, resp.etags...)
+
+	etag := int64(0)
+	fmt.Sscan(resp.Etag, &etag)
+	if newest := urgent[len(urgent)-1].Created; newest > etag {
+		resp.Etag = fmt.Sprintf("%d", newest)
+	}
+}
+
+// emptyUrgent drops the urgent lane. Must be called with c.lock held.
+func (c *Channel) emptyUrgent() {
+	if c.urgent != nil {
+		c.urgent.Empty()
+		c.urgent = nil
+	}
+}
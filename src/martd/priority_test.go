@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pubUrgent(t *testing.T, c *Channel, data string) int64 {
+	t.Helper()
+	etag, err := c.PubPriority([]byte(data), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return etag
+}
+
+func TestPriorityOrder(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	first := pubN(t, c, 1)[0]
+	urgent := pubUrgent(t, c, "urgent")
+	last := pubN(t, c, 1)[0]
+
+	cr, _ := c.Poll(0)
+	if fmt.Sprint(cr.etags) != fmt.Sprint([]int64{urgent, first, last}) {
+		t.Fatalf("got %v, want urgent %d first", cr.etags, urgent)
+	}
+	if cr.Etag != strconv.FormatInt(last, 10) {
+		t.Fatalf("etag %s, want newest %d", cr.Etag, last)
+	}
+	if _, has := c.Poll(last); has {
+		t.Fatal("new messages after the newest")
+	}
+
+	cr, _ = c.Poll(first)
+	if fmt.Sprint(cr.etags) != fmt.Sprint([]int64{urgent, last}) {
+		t.Fatalf("after %d got %v", first, cr.etags)
+	}
+	cr, _ = c.Poll(urgent)
+	if fmt.Sprint(cr.etags) != fmt.Sprint([]int64{last}) {
+		t.Fatalf("after urgent %d got %v", urgent, cr.etags)
+	}
+}
+
+func TestPriorityOne2One(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10, One2One: true})
+	pubN(t, c, 1)
+	pubUrgent(t, c, "urgent")
+
+	cr, _ := c.Poll(0)
+	if len(cr.Payload) != 2 || cr.Payload[1] != "urgent" {
+		t.Fatalf("got %v, want them in order", cr.Payload)
+	}
+}
+
+func TestPriorityWhilePolling(t *testing.T) {
+	const n = 500
+	c := NewChannel(ChannelOptions{Size: 2 * n})
+	wg := sync.WaitGroup{}
+	for p := 0; p < 2; p++ {
+		wg.Add(1)
+		go func(urgent bool) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				var err error
+				if urgent {
+					_, err = c.PubPriority([]byte("urgent"), 1)
+				} else {
+					_, err = c.Pub([]byte("hello"))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(p == 1)
+	}
+
+	seen, etag := map[int64]bool{}, int64(0)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seen) < 2*n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d of %d messages", len(seen), 2*n)
+		}
+		cr, has := c.Poll(etag)
+		if !has {
+			continue
+		}
+		for _, e := range cr.etags {
+			if seen[e] {
+				t.Fatalf("got %d twice", e)
+			}
+			seen[e] = true
+		}
+		etag, _ = strconv.ParseInt(cr.Etag, 10, 64)
+	}
+	wg.Wait()
+}
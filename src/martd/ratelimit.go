@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Channels created with rate > 0 take at most rate messages a second, with
+	bursts of up to burst messages. It is a token bucket, kept as the time
+	the bucket will be full again (GCRA), so one int64 updated with CAS is
+	all the state there is, and Pub does not have to take c.lock for it.
+*/
+
+type rateLimiter struct {
+	tat int64 // unix nanos when the bucket is full again
+}
+
+// allow takes n tokens, if the bucket has them.
+func (l *rateLimiter) allow(n int, rate float64, burst uint) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst == 0 {
+		burst = 1
+	}
+
+	interval := int64(float64(time.Second) / rate)
+	tolerance := interval * int64(burst)
+	now := time.Now().UnixNano()
+	for {
+		old := atomic.LoadInt64(&l.tat)
+		tat := old
+		if tat < now {
+			tat = now
+		}
+		next := tat + interval*int64(n)
+		if next-now > tolerance {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.tat, old, next) {
+			return true
+		}
+	}
+}
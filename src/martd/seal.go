@@ -0,0 +1,74 @@
+package main
+
+/*
+	A sealed channel takes no more messages, but what it has can still be
+	read, like for a work queue that is winding down. Once the last message
+	is gone, read or expired, and acked if the channel wants acks, the
+	channel is deleted, and its subscribers get a ChannelEvent with Drained
+	set, a response with "drained": true over http.
+*/
+
+// Seal stops the channel taking messages, publishing returns
+// ErrChannelSealed, and has it deleted once drained.
+func (c *Channel) Seal() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.inited {
+		return ErrChannelNotFound
+	}
+	c.sealed = true
+	walLog(c, walSeal, 0)
+	c.stopCoalescing()
+	c.roomFreed()
+	infof("channel sealed: %s", c.Name)
+	c.checkDrained()
+	return nil
+}
+
+// Sealed tells if Seal has been called.
+func (c *Channel) Sealed() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.sealed
+}
+
+// checkDrained deletes a sealed channel once nothing is left in it. It is
+// deleted after c.lock has been released. Must be called with c.lock held.
+func (c *Channel) checkDrained() {
+	if !c.sealed || c.draining {
+		return
+	}
+	if c.Messages.Length() != 0 || len(c.inflight) != 0 {
+		return
+	}
+	if c.urgent != nil && c.urgent.Length() != 0 {
+		return
+	}
+	c.draining = true
+	go c.drained()
+}
+
+func (c *Channel) drained() {
+	s := shardOf(c.Name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.channels[c.Name] == c {
+		delete(s.channels, c.Name)
+		channelGone(c)
+		infof("channel drained: %s", c.Name)
+		channelDeleted(c.Name)
+		walLog(c, walDelete, 0)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.deleted = true
+	if c.reaper != nil {
+		c.reaper.Stop()
+	}
+	EmptyChannel(c)
+	c.queueAll(&ChannelEvent{Chan: c, Drained: true})
+}
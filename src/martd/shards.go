@@ -0,0 +1,101 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Channels are kept in shards, by a hash of their name, each with its own
+	lock, so lookups of different channels do not wait on each other.
+
+	Lock order is PatternLock, then a shard lock, then the channel lock.
+	Only one shard is locked at a time.
+*/
+
+const nShards = 256
+
+type channelShard struct {
+	lock     sync.RWMutex
+	channels map[string]*Channel
+}
+
+var shards [nShards]*channelShard
+
+func init() {
+	for i := range shards {
+		shards[i] = &channelShard{channels: make(map[string]*Channel)}
+	}
+}
+
+func shardOf(name string) *channelShard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return shards[h.Sum32()%nShards]
+}
+
+// eachChannel calls f for every channel, with its shard read locked.
+func eachChannel(f func(ch *Channel)) {
+	for _, s := range shards {
+		s.lock.RLock()
+		for _, ch := range s.channels {
+			f(ch)
+		}
+		s.lock.RUnlock()
+	}
+}
+
+// allChannels returns all channels, none of them locked.
+func allChannels() []*Channel {
+	chans := []*Channel{}
+	eachChannel(func(ch *Channel) {
+		chans = append(chans, ch)
+	})
+	return chans
+}
+
+// NumChannels returns how many channels there are.
+func NumChannels() int {
+	n := 0
+	for _, s := range shards {
+		s.lock.RLock()
+		n += len(s.channels)
+		s.lock.RUnlock()
+	}
+	return n
+}
+
+// ResetChannels forgets all channels and pattern subscriptions, for tests
+// that need a clean slate. Subscribers still waiting are told their channel
+// is gone. Nothing is removed from the db.
+func ResetChannels() {
+	PatternLock.Lock()
+	defer PatternLock.Unlock()
+	PatternSubs = make(map[*PatternSub]bool)
+
+	for _, s := range shards {
+		s.lock.Lock()
+		for _, ch := range s.channels {
+			ch.lock.Lock()
+			if ch.reaper != nil {
+				ch.reaper.Stop()
+				ch.reaper = nil
+			}
+			ch.deleted = true
+			ch.stopLeases()
+			if ch.Messages != nil {
+				ch.Messages.Empty() // frees up memory budget
+			}
+			ch.emptyUrgent()
+			ch.stopCoalescing()
+			ch.roomFreed()
+			ch.kick()
+			ch.lock.Unlock()
+		}
+		s.channels = make(map[string]*Channel)
+		s.lock.Unlock()
+	}
+	atomic.StoreInt64(&liveChannels, 0)
+	resetLRU()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+	On SIGINT or SIGTERM martd stops taking new subscribers, tells everyone
+	waiting that it is going away, so they can reconnect elsewhere, writes a
+	snapshot if -snapshot is set, and waits for requests in flight for up to
+	-shutdown-timeout before closing whatever is left.
+*/
+
+var (
+	ShutdownTimeout time.Duration
+	Server          *http.Server // set by ServeHTTP
+	shuttingDown    int32
+	shutdownDone    = make(chan struct{})
+)
+
+func init() {
+	flag.DurationVar(
+		&ShutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"How long to wait for clients to go away on shutdown.",
+	)
+}
+
+// ShuttingDown tells if Shutdown has been called, subscribe handlers turn
+// new clients away then.
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+// Shutdown sends every subscriber of every channel a ChannelEvent with
+// Shutdown set, snapshots if configured, and stops the http server, force
+// closing connections still open when ctx is done.
+func Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		<-shutdownDone
+		return nil
+	}
+	defer close(shutdownDone)
+
+	eachChannel(func(ch *Channel) {
+		ch.lock.Lock()
+		ch.shutdown()
+		ch.lock.Unlock()
+	})
+
+	if SnapshotFile != "" {
+		if err := WriteSnapshot(); err != nil {
+			log.Println("Snapshot failed:", err)
+		}
+	}
+
+	if Server == nil {
+		return nil
+	}
+	if err := Server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown timed out, closing remaining clients:", err)
+		return Server.Close()
+	}
+	return nil
+}
+
+// shutdown tells all clients the server is going away, after any fanout
+// still to go out, and drops them. Clients that do not take it in time miss
+// it, their connection gets closed anyway. Must be called with c.lock held.
+func (c *Channel) shutdown() {
+	c.queueAll(&ChannelEvent{Chan: c, Shutdown: true})
+}
+
+// ShutdownOnSignal calls Shutdown on SIGINT or SIGTERM.
+func ShutdownOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	log.Println("Shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		log.Println("Shutdown:", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	SnapshotFile  string
+	SnapshotEvery time.Duration
+)
+
+func init() {
+	flag.StringVar(
+		&SnapshotFile, "snapshot", "",
+		"Snapshot file, channels are restored from it on start (optional).",
+	)
+	flag.DurationVar(
+		&SnapshotEvery, "snapshot-every", time.Minute,
+		"How often to write the snapshot file.",
+	)
+}
+
+type snapshotChannel struct {
+	Name     string         `json:"name"`
+	Options  ChannelOptions `json:"options"`
+	Messages []*Message     `json:"messages"`
+	Urgent   []*Message     `json:"urgent,omitempty"`  // of the priority lane
+	Unacked  []*Message     `json:"unacked,omitempty"` // leased, see ack.go
+	Sealed   bool           `json:"sealed,omitempty"`
+}
+
+// snapshotMessages copies the messages of lane, for writing them out.
+func snapshotMessages(lane *CircularMessageArray) []*Message {
+	var msgs []*Message
+	for _, m := range lane.Snapshot() {
+		msgs = append(msgs, snapshotMessage(m))
+	}
+	return msgs
+}
+
+func snapshotMessage(m *Message) *Message {
+	return &Message{
+		Data: m.Payload(), Created: m.Created, ID: m.ID, Headers: m.Headers,
+	}
+}
+
+// SnapshotTo writes all channels and their messages to w as gzipped json.
+// Each channel is only read locked while its messages are copied.
+func SnapshotTo(w io.Writer) error {
+	chans := allChannels()
+
+	snap := make([]*snapshotChannel, 0, len(chans))
+	for _, ch := range chans {
+		ch.lock.RLock()
+		if ch.inited {
+			sc := &snapshotChannel{
+				Name: ch.Name, Options: ch.ChannelOptions, Sealed: ch.sealed,
+				Messages: snapshotMessages(ch.Messages),
+			}
+			if ch.urgent != nil {
+				sc.Urgent = snapshotMessages(ch.urgent)
+			}
+			for _, l := range ch.inflight {
+				sc.Unacked = append(sc.Unacked, snapshotMessage(l.m))
+			}
+			snap = append(snap, sc)
+		}
+		ch.lock.RUnlock()
+	}
+
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(snap); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// RestoreFrom loads channels written by SnapshotTo. Messages keep their
+// etags, so clients can pick up where they left. Messages a channel already
+// has are skipped. Those that were leased but not acked are back in the
+// channel, for any client to take.
+func RestoreFrom(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	snap := []*snapshotChannel{}
+	if err := json.NewDecoder(gz).Decode(&snap); err != nil {
+		return err
+	}
+
+	for _, sc := range snap {
+		ch, _, err := getOrCreateChannel(sc.Name, sc.Options)
+		if err != nil {
+			log.Println("Could not restore channel:", sc.Name, err)
+			continue
+		}
+
+		msgs := append(sc.Messages, sc.Unacked...)
+		sort.Slice(msgs, func(i, j int) bool {
+			return msgs[i].Created < msgs[j].Created
+		})
+
+		ch.lock.Lock()
+		ch.restore(msgs, sc.Urgent)
+		ch.sealed = ch.sealed || sc.Sealed
+		ch.lock.Unlock()
+	}
+	return nil
+}
+
+// restore pushes msgs, and urgent to the priority lane, oldest first, so
+// etags keep going up. Messages c already has are skipped. Must be called
+// with c.lock held.
+func (c *Channel) restore(msgs, urgent []*Message) {
+	for len(msgs) != 0 || len(urgent) != 0 {
+		var m *Message
+		lane := c.Messages
+		if len(urgent) != 0 && (len(msgs) == 0 || urgent[0].Created < msgs[0].Created) {
+			if c.urgent == nil {
+				c.urgent = NewCircularMessageArray(c.Size)
+			}
+			lane, m, urgent = c.urgent, urgent[0], urgent[1:]
+		} else {
+			m, msgs = msgs[0], msgs[1:]
+		}
+
+		if m.Created <= c.lastEtag {
+			continue
+		}
+		lane.Push(m)
+		c.lastEtag = m.Created
+	}
+}
+
+// ReadSnapshot restores from SnapshotFile, a missing file is not an error.
+func ReadSnapshot() error {
+	f, err := os.Open(SnapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return RestoreFrom(f)
+}
+
+// WriteSnapshot writes SnapshotFile, via a temp file so a crash midway does
+// not leave a broken snapshot behind. The wal is then compacted.
+func WriteSnapshot() error {
+	off := walOffset()
+
+	tmp := SnapshotFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := SnapshotTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, SnapshotFile); err != nil {
+		return err
+	}
+	return compactWAL(off)
+}
+
+func Snapshotter() {
+	for {
+		time.Sleep(SnapshotEvery)
+		if err := WriteSnapshot(); err != nil {
+			log.Println("Snapshot failed:", err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reload snapshots all channels, drops them, and restores them from the
+// snapshot.
+func reload(t *testing.T) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := SnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ResetChannels()
+	if err := RestoreFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	defer ResetChannels()
+	c := mustCreate(t, "test/snap")
+	etags := pubN(t, c, 3)
+	if err := c.Seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	reload(t)
+	c = GetChannel("test/snap")
+	cr, _ := c.Poll(0)
+	if cr == nil || len(cr.msgs) != 3 {
+		t.Fatalf("restored %v", cr)
+	}
+	for i, m := range cr.msgs {
+		if m.Created != etags[i] || string(m.Payload()) != "hello" {
+			t.Errorf("message %d is %d %q, want %d", i, m.Created, m.Payload(), etags[i])
+		}
+	}
+	if _, err := c.Pub([]byte("hello")); err != ErrChannelSealed {
+		t.Fatalf("restored channel is not sealed: %v", err)
+	}
+}
+
+func TestSnapshotUrgent(t *testing.T) {
+	defer ResetChannels()
+	c := mustCreate(t, "test/snap")
+	pubN(t, c, 1)
+	urgent, err := c.PubPriority([]byte("urgent"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubN(t, c, 1)
+
+	reload(t)
+	c = GetChannel("test/snap")
+	cr, _ := c.Poll(0)
+	if cr == nil || len(cr.Payload) != 3 {
+		t.Fatalf("restored %v", cr)
+	}
+	if cr.Payload[0] != "urgent" || cr.etags[0] != urgent {
+		t.Fatalf("urgent message not first: %v", cr.Payload)
+	}
+	if _, err := c.PubPriority([]byte("urgent"), 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotOptions(t *testing.T) {
+	defer ResetChannels()
+	opts := ChannelOptions{
+		Size: 5, Life: time.Hour, Key: "secret", One2One: true,
+	}
+	if _, err := GetOrCreateChannel("test/snap", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	reload(t)
+	got := GetChannel("test/snap").options()
+	if got.Size != 5 || got.Life != time.Hour || got.Key != "secret" || !got.One2One {
+		t.Fatalf("restored options %+v", got)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	defer func(file string) { SnapshotFile = file }(SnapshotFile)
+	SnapshotFile = filepath.Join(t.TempDir(), "snapshot")
+	defer ResetChannels()
+	if err := ReadSnapshot(); err != nil {
+		t.Fatalf("missing snapshot: %v", err)
+	}
+	etags := pubN(t, mustCreate(t, "test/snap"), 2)
+
+	if err := WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	ResetChannels()
+	if err := ReadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// restoring again does not push the same messages twice
+	if err := ReadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	cr, _ := GetChannel("test/snap").Poll(0)
+	if cr == nil || len(cr.etags) != 2 || cr.etags[1] != etags[1] {
+		t.Fatalf("restored %v, want %v", cr, etags)
+	}
+}
+
+func TestSnapshotWhilePublishing(t *testing.T) {
+	defer ResetChannels()
+	const chans, n = 4, 200
+	wg := sync.WaitGroup{}
+	for i := 0; i < chans; i++ {
+		c := mustCreate(t, fmt.Sprintf("test/snap%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if _, err := c.Pub([]byte("hello")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := SnapshotTo(&bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	reload(t)
+	for i := 0; i < chans; i++ {
+		st := GetChannel(fmt.Sprintf("test/snap%d", i)).Stats()
+		if st.Messages != 10 {
+			t.Errorf("restored %d messages of %s, want 10", st.Messages, st.Name)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+	/events takes the same query as /sub and streams messages as server
+	sent events. Each message is an event named after its channel, so
+	browsers listen with addEventListener("channel", ...). The event id
+	has the etags of all channels, url encoded, so when the browser
+	reconnects with Last-Event-ID it picks up where it left.
+*/
+
+func SSEHandler(w http.ResponseWriter, r *http.Request) {
+	nSub.Add(1)
+	nSubAll.Add(1)
+	defer nSub.Add(-1)
+
+	if ShuttingDown() {
+		unavailable(w)
+		return
+	}
+
+	req, err := parseSubRequest(r)
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	if len(req.patterns) != 0 {
+		reject(w, "patterns are not supported for events")
+		return
+	}
+	if err := req.lastEventID(r.Header.Get("Last-Event-ID")); err != nil {
+		reject(w, err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		reject(w, "server issue, handler does not support Flusher")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	names := make([]string, 0, len(req.etags))
+	for name := range req.etags {
+		names = append(names, name)
+	}
+
+	ctx := r.Context()
+	evch := req.opts.EventChan(16)
+	lagged := make(chan struct{}, 1)
+
+	if req.heartbeat != 0 {
+		defer Heartbeat(evch, req.heartbeat)()
+	}
+
+	for !ShuttingDown() {
+		// subscribe first, then catch up, so nothing published in between
+		// is lost. Whatever we get twice is skipped by etag.
+		subs, err := SubStream(ctx, names, req.opts, evch, lagged)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			flusher.Flush()
+			return
+		}
+		for _, ch := range subs {
+			// a max_backlog at a time, till we have it all
+			for more := true; more; {
+				cr, has := ch.PollOptions(req.etags[ch.Name], req.opts)
+				if !has {
+					break
+				}
+				etag := int64(0)
+				fmt.Sscan(cr.Etag, &etag)
+				req.etags[ch.Name] = etag
+				for _, payload := range cr.Payload {
+					req.sseEvent(w, ch.Name, payload)
+				}
+				flusher.Flush()
+				more = cr.More
+			}
+		}
+		flusher.Flush()
+
+	wait:
+		for {
+			select {
+			case cm := <-evch:
+				if cm.Heartbeat {
+					fmt.Fprint(w, ": keepalive\n\n")
+					flusher.Flush()
+					continue
+				}
+				if cm.Shutdown {
+					fmt.Fprint(w, "event: shutdown\ndata: \n\n")
+					flusher.Flush()
+					MultiUnSub(subs, evch)
+					return
+				}
+				if cm.Drained {
+					fmt.Fprintf(w, "event: drained\ndata: %s\n\n", cm.Chan.Name)
+					flusher.Flush()
+				}
+				if cm.Mesg == nil {
+					// channel is gone, start over on the new one
+					req.etags[cm.Chan.Name] = 0
+					break wait
+				}
+				for _, m := range cm.Messages() {
+					if m.Created <= req.etags[cm.Chan.Name] {
+						continue
+					}
+					req.etags[cm.Chan.Name] = m.Created
+					req.sseEvent(w, cm.Chan.Name, cm.Chan.encode(m.Payload()))
+				}
+				flusher.Flush()
+			case <-lagged:
+				break wait
+			case <-ctx.Done():
+				MultiUnSub(subs, evch)
+				return
+			}
+		}
+		MultiUnSub(subs, evch)
+	}
+}
+
+// lastEventID overrides etags with those in the Last-Event-ID header.
+func (req *subRequest) lastEventID(id string) error {
+	if id == "" {
+		return nil
+	}
+	vals, err := url.ParseQuery(id)
+	if err != nil {
+		return errors.New("invalid Last-Event-ID: " + err.Error())
+	}
+	for name := range req.etags {
+		if v := vals.Get(name); v != "" {
+			etag := int64(0)
+			if _, err := fmt.Sscan(v, &etag); err != nil {
+				return errors.New("invalid Last-Event-ID: " + err.Error())
+			}
+			req.etags[name] = etag
+		}
+	}
+	return nil
+}
+
+func (req *subRequest) sseEvent(w http.ResponseWriter, name, payload string) {
+	ids := url.Values{}
+	for n, etag := range req.etags {
+		ids.Set(n, fmt.Sprintf("%d", etag))
+	}
+
+	fmt.Fprintf(w, "event: %s\nid: %s\n", name, ids.Encode())
+	for _, line := range strings.Split(payload, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+/*
+	/stats without a channel pages through the stats of all channels, in
+	name order, for admin tools on servers with too many channels for
+	/debug/vars. prefix narrows it down, limit (100, at most 1000) is how
+	many channels a page has, and after is where the page starts, the next
+	of the previous page. Channel keys are not asked for, like /channels and
+	/debug/vars.
+*/
+
+const (
+	statsPageLimit = 100
+	statsPageMax   = 1000
+)
+
+type StatsPage struct {
+	Total    int             `json:"total"` // channels matching prefix
+	Channels []*ChannelStats `json:"channels"`
+	Next     string          `json:"next,omitempty"` // after, for the next page
+}
+
+// ChannelStatsPage returns the stats of up to limit channels starting with
+// prefix, and named after after, in name order.
+func ChannelStatsPage(prefix, after string, limit int) *StatsPage {
+	if limit <= 0 {
+		limit = statsPageLimit
+	}
+	if limit > statsPageMax {
+		limit = statsPageMax
+	}
+
+	names := ListChannelsPrefix(prefix)
+	page := &StatsPage{Total: len(names), Channels: []*ChannelStats{}}
+	i := 0
+	if after != "" {
+		i = sort.SearchStrings(names, after)
+		if i < len(names) && names[i] == after {
+			i++
+		}
+	}
+	for ; i < len(names) && len(page.Channels) < limit; i++ {
+		page.Channels = append(page.Channels, peekChannel(names[i]).Stats())
+	}
+	if i < len(names) {
+		page.Next = names[i-1]
+	}
+	return page
+}
+
+// Json is the page as json, with etags as numbers if numberEtags, see
+// StatsJson.
+func (p *StatsPage) Json(numberEtags bool) ([]byte, error) {
+	for _, st := range p.Channels {
+		st.numberEtags = numberEtags
+	}
+	return json.MarshalIndent(p, " ", "    ")
+}
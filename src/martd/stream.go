@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+)
+
+/*
+	Stream is for using martd as a library: it hides evch, etags and
+	subscribing again after falling behind, and gives plain payloads to
+	range over. What the channel holds comes first, oldest first, then new
+	messages as they are published. A consumer that falls too far behind
+	is caught up from the channel's buffer, so it only misses messages the
+	buffer no longer has.
+
+	On a one2one channel the stream takes messages like any client. If the
+	channel wants acks, a message is acked once it is sent on, those taken
+	but not sent when ctx is done are requeued after the ack timeout.
+*/
+
+// Stream sends the payload of every message of the channel on the returned
+// channel, the ones it holds already first, then new ones as they come,
+// till ctx is done or the channel is gone, then it is closed. Binary
+// payloads come as they were published, not base64 encoded.
+func (c *Channel) Stream(ctx context.Context) <-chan []byte {
+	out := make(chan []byte)
+	go c.stream(ctx, out)
+	return out
+}
+
+func (c *Channel) stream(ctx context.Context, out chan<- []byte) {
+	defer close(out)
+
+	evch := make(chan *ChannelEvent, 16)
+	lagged := make(chan struct{}, 1)
+	etag := int64(0)
+
+	// send is false once ctx is done
+	send := func(msgs []*Message) bool {
+		for _, m := range msgs {
+			if m.Created <= etag {
+				continue // got it already
+			}
+			etag = m.Created
+			select {
+			case out <- m.Payload():
+				c.Ack(m.Created, "") // ours now, if leased
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		sub := SubOptions{}.subscriber(ctx.Done())
+		sub.stream = true
+		sub.lagged = lagged
+		backlog, err := c.catchUp(etag, evch, sub)
+		if err != nil {
+			warnf("stream of %s: %s", c.Name, err)
+			return
+		}
+
+		ok, live := send(backlog), true
+		for ok && live {
+			select {
+			case cm := <-evch:
+				if cm.Mesg == nil {
+					// channel is gone, or drained, or we are shutting down
+					ok = false
+					continue
+				}
+				ok = send(cm.Messages())
+			case <-lagged:
+				live = false
+			case <-ctx.Done():
+				ok = false
+			}
+		}
+		c.UnSub(evch)
+		if !ok {
+			return
+		}
+	}
+}
+
+// catchUp subscribes evch, and returns the messages after etag, oldest
+// first, under one lock so nothing published in between is missed.
+func (c *Channel) catchUp(
+	etag int64, evch chan *ChannelEvent, sub *Subscriber,
+) ([]*Message, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.addClient(evch, sub); err != nil {
+		return nil, err
+	}
+	c.expireOldMessages(Clock())
+
+	msgs := c.urgentAfter(etag)
+	if has, ith, _ := c.sinceEtag(etag); has {
+		c.Messages.ForEach(ith, func(m *Message) bool {
+			msgs = append(msgs, m)
+			return true
+		})
+	}
+	for _, m := range msgs {
+		m.handed()
+	}
+	if c.One2One && c.Messages != nil && len(msgs) != 0 {
+		c.Empty() // ours now, like Append
+		c.leaseTaken(&ChanResponse{msgs: msgs}, sub)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created < msgs[j].Created
+	})
+	return msgs, nil
+}
+
+// Reader is Stream as an io.Reader, each payload followed by a newline. Read
+// returns io.EOF once the stream is closed.
+func (c *Channel) Reader(ctx context.Context) io.Reader {
+	return &streamReader{payloads: c.Stream(ctx)}
+}
+
+type streamReader struct {
+	payloads <-chan []byte
+	buf      []byte // what is left of the payload being read
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		data, ok := <-r.payloads
+		if !ok {
+			return 0, io.EOF
+		}
+		r.buf = append(append(make([]byte, 0, len(data)+1), data...), '\n')
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
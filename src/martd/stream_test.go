@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+)
+
+// next reads a payload off out, failing if none comes.
+func next(t *testing.T, out <-chan []byte) string {
+	t.Helper()
+	select {
+	case data, ok := <-out:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		return string(data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no payload")
+	}
+	return ""
+}
+
+func TestStream(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	pubN(t, c, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := c.Stream(ctx)
+
+	next(t, out)
+	next(t, out)
+	if _, err := c.Pub([]byte("live")); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(t, out); got != "live" {
+		t.Fatalf("got %q, want live", got)
+	}
+
+	cancel()
+	for range out {
+	}
+}
+
+func TestStreamOne2OneCancel(t *testing.T) {
+	withWAL(t)
+	c := mustCreateAcked(t, "test/acked")
+	pubN(t, c, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := c.Stream(ctx)
+
+	next(t, out)
+	cancel() // out is not read again, the rest is not sent
+
+	time.Sleep(100 * time.Millisecond)
+	take(t, c, "a", 2)
+}
+
+func TestStreamReader(t *testing.T) {
+	c := NewChannel(ChannelOptions{Size: 10})
+	pubN(t, c, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lines := bufio.NewScanner(c.Reader(ctx))
+	for i := 0; i < 2; i++ {
+		if !lines.Scan() || lines.Text() != "hello" {
+			t.Fatalf("line %d is %q, %v", i, lines.Text(), lines.Err())
+		}
+	}
+}
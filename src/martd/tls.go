@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+)
+
+/*
+	martd speaks plain http unless -tls-cert and -tls-key are given. With
+	-tls-client-ca as well, clients must present a certificate signed by
+	that CA, on top of any channel key, and the common name of the
+	certificate is who they are: it is the identity subscribers show up
+	with in /presence, and publishers are logged with.
+*/
+
+var (
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+)
+
+func init() {
+	flag.StringVar(&TLSCert, "tls-cert", "", "TLS certificate file.")
+	flag.StringVar(&TLSKey, "tls-key", "", "TLS key file.")
+	flag.StringVar(
+		&TLSClientCA, "tls-client-ca", "",
+		"Require client certificates signed by this CA (mTLS).",
+	)
+}
+
+// TLSConfig returns the tls config as per the -tls flags, nil for plain
+// http.
+func TLSConfig() (*tls.Config, error) {
+	if TLSCert == "" && TLSKey == "" {
+		if TLSClientCA != "" {
+			return nil, errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if TLSCert == "" || TLSKey == "" {
+		return nil, errors.New("-tls-cert and -tls-key go together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(TLSCert, TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if TLSClientCA == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in " + TLSClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// clientIdentity is the common name of the verified client certificate of
+// r, "" without mTLS.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	The write ahead log has every published message, one json object per
+	line, written before the message is delivered, and every message or
+	channel that went away since: taken by a one2one client, dropped with
+	Clear or the admin flush, deleted, expired or drained, so a restart does
+	not bring them back. A message leased to a client is only taken once
+	acked, a requeued one is logged again with its new etag. Seals are
+	logged too. On start it is replayed on top of the snapshot. Every
+	snapshot compacts the log, dropping entries the snapshot already has.
+	Without -snapshot the log is never compacted.
+
+	-wal-fsync picks durability: "always" syncs on every Pub, "interval"
+	syncs once a second, "never" leaves it to the OS.
+*/
+
+var (
+	WALFile  string
+	WALFsync string
+	wal      *os.File // nil if there is no wal, walLock guards it
+	walLock  sync.Mutex
+)
+
+func init() {
+	flag.StringVar(&WALFile, "wal", "", "Write ahead log file (optional).")
+	flag.StringVar(
+		&WALFsync, "wal-fsync", "interval",
+		"When to fsync the wal: always, interval or never.",
+	)
+}
+
+// what a walEntry is about, a published message if none
+const (
+	walTake   = "take"   // message of Etag is gone
+	walClear  = "clear"  // messages up to Etag are gone
+	walDelete = "delete" // channel and its messages are gone
+	walSeal   = "seal"
+)
+
+type walEntry struct {
+	Channel string            `json:"channel"`
+	Options *ChannelOptions   `json:"options,omitempty"`
+	Etag    int64             `json:"etag"`
+	Data    []byte            `json:"data,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Op      string            `json:"op,omitempty"`
+}
+
+// WALAppend logs m, it is a no-op if there is no wal.
+func WALAppend(c *Channel, m *Message) error {
+	if c.detached {
+		return nil
+	}
+	opts := c.ChannelOptions
+	return walWrite(&walEntry{
+		Channel: c.Name, Options: &opts, Etag: m.Created, Data: m.Payload(),
+		ID: m.ID, Headers: m.Headers,
+	})
+}
+
+// walLog logs op on c, for etag, warning if the wal could not be written.
+func walLog(c *Channel, op string, etag int64) {
+	if c.detached {
+		return
+	}
+	if err := walWrite(&walEntry{Channel: c.Name, Etag: etag, Op: op}); err != nil {
+		warnf("could not log %s of %s to wal: %s", op, c.Name, err)
+	}
+}
+
+func walWrite(e *walEntry) error {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	if wal == nil {
+		return nil
+	}
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := wal.Write(append(j, '\n')); err != nil {
+		return err
+	}
+	if WALFsync == "always" {
+		return wal.Sync()
+	}
+	return nil
+}
+
+// OpenWAL replays WALFile into channels and opens it for appending.
+func OpenWAL() error {
+	f, err := os.OpenFile(WALFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := replayWAL(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	walLock.Lock()
+	wal = f
+	walLock.Unlock()
+	if WALFsync == "interval" {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+				walLock.Lock()
+				wal.Sync()
+				walLock.Unlock()
+			}
+		}()
+	}
+	return nil
+}
+
+// walChannel is what the wal says about a channel, on top of what the
+// snapshot has.
+type walChannel struct {
+	opts    *ChannelOptions // of the first push logged, nil if none
+	msgs    map[int64]*Message
+	taken   map[int64]bool // snapshot messages that are gone
+	cleared int64          // snapshot messages up to this are gone
+	deleted bool           // and nothing pushed since
+	dropped bool           // all snapshot messages are gone
+	sealed  bool
+}
+
+func replayWAL(r io.Reader) error {
+	chans := map[string]*walChannel{}
+	order := []string{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		e := &walEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// most likely a half written last line
+			log.Println("Bad wal entry:", err)
+			continue
+		}
+
+		wc := chans[e.Channel]
+		if wc == nil {
+			wc = &walChannel{
+				msgs: map[int64]*Message{}, taken: map[int64]bool{},
+			}
+			chans[e.Channel] = wc
+			order = append(order, e.Channel)
+		}
+		wc.replay(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		if err := chans[name].apply(name); err != nil {
+			log.Println("Could not replay wal for:", name, err)
+		}
+	}
+	return nil
+}
+
+func (wc *walChannel) replay(e *walEntry) {
+	switch e.Op {
+	case "":
+		if wc.opts == nil || wc.deleted {
+			wc.opts = e.Options
+		}
+		wc.deleted = false
+		wc.msgs[e.Etag] = &Message{
+			Data: e.Data, Created: e.Etag, ID: e.ID, Headers: e.Headers,
+		}
+	case walTake:
+		delete(wc.msgs, e.Etag)
+		wc.taken[e.Etag] = true
+	case walClear:
+		for etag := range wc.msgs {
+			if etag <= e.Etag {
+				delete(wc.msgs, etag)
+			}
+		}
+		if e.Etag > wc.cleared {
+			wc.cleared = e.Etag
+		}
+	case walDelete:
+		wc.msgs = map[int64]*Message{}
+		wc.deleted, wc.dropped, wc.sealed = true, true, false
+	case walSeal:
+		wc.sealed = true
+	}
+}
+
+// apply brings channel name to what the wal says.
+func (wc *walChannel) apply(name string) error {
+	if wc.deleted {
+		DeleteChannel(name)
+		return nil
+	}
+	opts := ChannelOptions{}
+	if wc.opts != nil {
+		opts = *wc.opts
+	}
+	if wc.dropped {
+		DeleteChannel(name) // what the snapshot has is from before
+	}
+	ch, _, err := getOrCreateChannel(name, opts)
+	if err != nil {
+		return err
+	}
+
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	msgs := []*Message{}
+	for _, m := range ch.Messages.Snapshot() {
+		if wc.msgs[m.Created] != nil {
+			continue // logged since
+		}
+		if m.Created <= wc.cleared || wc.taken[m.Created] {
+			Persist(ch, nil, m)
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	for _, m := range wc.msgs {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created < msgs[j].Created
+	})
+
+	ch.Messages.Empty()
+	for _, m := range msgs {
+		ch.Messages.Push(m)
+		if m.Created > ch.lastEtag {
+			ch.lastEtag = m.Created
+		}
+	}
+	if wc.cleared > ch.lastEtag {
+		ch.lastEtag = wc.cleared
+	}
+	ch.sealed = ch.sealed || wc.sealed
+	return nil
+}
+
+// walOffset is where the wal ends now, everything before it is in any
+// snapshot started after this call.
+func walOffset() int64 {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	if wal == nil {
+		return 0
+	}
+
+	off, err := wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	return off
+}
+
+// compactWAL drops the first off bytes of the wal.
+func compactWAL(off int64) error {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	if wal == nil || off == 0 {
+		return nil
+	}
+
+	tmp := WALFile + ".tmp"
+	nf, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := wal.Seek(off, io.SeekStart); err != nil {
+		nf.Close()
+		return err
+	}
+	if _, err := io.Copy(nf, wal); err != nil {
+		nf.Close()
+		return err
+	}
+	if err := nf.Sync(); err != nil {
+		nf.Close()
+		return err
+	}
+	nf.Close()
+
+	if err := os.Rename(tmp, WALFile); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(WALFile, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.Close()
+	wal = f
+	return nil
+}
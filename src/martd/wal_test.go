@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// withWAL has channels logged to a wal, and snapshotted to a file, of their
+// own, till the test is done.
+func withWAL(t *testing.T) {
+	file, fsync, snap := WALFile, WALFsync, SnapshotFile
+	t.Cleanup(func() {
+		closeWAL()
+		ResetChannels()
+		WALFile, WALFsync, SnapshotFile = file, fsync, snap
+	})
+	ResetChannels()
+	dir := t.TempDir()
+	WALFile, WALFsync = filepath.Join(dir, "wal"), "never"
+	SnapshotFile = filepath.Join(dir, "snapshot")
+	if err := OpenWAL(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restart drops all channels and gets them back from the snapshot and the
+// wal, like martd coming up again.
+func restart(t *testing.T) {
+	t.Helper()
+	closeWAL()
+	ResetChannels()
+	if err := ReadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenWAL(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeWAL() {
+	walLock.Lock()
+	defer walLock.Unlock()
+	if wal != nil {
+		wal.Close()
+		wal = nil
+	}
+}
+
+// etagsOf polls all messages of channel name, without taking them.
+func etagsOf(t *testing.T, name string) []int64 {
+	t.Helper()
+	cr, _ := GetChannel(name).Poll(0)
+	if cr == nil {
+		return nil
+	}
+	return cr.etags
+}
+
+func sameEtags(a, b []int64) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func TestWALReplay(t *testing.T) {
+	withWAL(t)
+	kept := pubN(t, mustCreate(t, "test/kept"), 3)
+	pubN(t, mustCreate(t, "test/deleted"), 1)
+	DeleteChannel("test/deleted")
+	sealed := mustCreate(t, "test/sealed")
+	pubN(t, sealed, 1)
+	if err := sealed.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	one, err := GetOrCreateChannel("test/one", ChannelOptions{Size: 10, One2One: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubN(t, one, 2)
+	one.Poll(0)
+
+	restart(t)
+	if got := etagsOf(t, "test/kept"); !sameEtags(got, kept) {
+		t.Errorf("replayed %v, want %v", got, kept)
+	}
+	if ChannelExists("test/deleted") {
+		t.Error("replayed a deleted channel")
+	}
+	if _, err := GetChannel("test/sealed").Pub([]byte("hello")); err != ErrChannelSealed {
+		t.Errorf("replayed channel is not sealed: %v", err)
+	}
+	if got := etagsOf(t, "test/one"); len(got) != 0 {
+		t.Errorf("replayed taken messages %v", got)
+	}
+	if _, err := GetChannel("test/kept").Pub([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWALAfterSnapshot(t *testing.T) {
+	withWAL(t)
+	c := mustCreate(t, "test/kept")
+	etags := pubN(t, c, 2)
+	if err := WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	etags = append(etags, pubN(t, c, 1)...)
+
+	restart(t)
+	if got := etagsOf(t, "test/kept"); !sameEtags(got, etags) {
+		t.Fatalf("restored %v, want %v", got, etags)
+	}
+}
+
+func TestWALTornLine(t *testing.T) {
+	withWAL(t)
+	etags := pubN(t, mustCreate(t, "test/kept"), 1)
+	walLock.Lock()
+	wal.Write([]byte(`{"channel":"test/kept","et`))
+	walLock.Unlock()
+
+	restart(t)
+	if got := etagsOf(t, "test/kept"); !sameEtags(got, etags) {
+		t.Fatalf("replayed %v, want %v", got, etags)
+	}
+}
+
+func TestWALConcurrent(t *testing.T) {
+	withWAL(t)
+	const chans, n = 4, 100
+	wg := sync.WaitGroup{}
+	for i := 0; i < chans; i++ {
+		c, err := GetOrCreateChannel(fmt.Sprintf("test/wal%d", i), ChannelOptions{Size: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if _, err := c.Pub([]byte("hello")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := WriteSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	restart(t)
+	for i := 0; i < chans; i++ {
+		if got := etagsOf(t, fmt.Sprintf("test/wal%d", i)); len(got) != n {
+			t.Errorf("replayed %d messages of test/wal%d, want %d", len(got), i, n)
+		}
+	}
+	if _, err := os.Stat(WALFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compacting left %s.tmp behind: %v", WALFile, err)
+	}
+}
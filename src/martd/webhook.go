@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+	A channel with a webhook has every message published to it POSTed to
+	that url, as json with the channel name, etag and data, for bridging
+	martd to other systems. Publishing only queues the message, workers do
+	the posting, retrying a few times on errors and non 2xx responses. If
+	the queue is full or the webhook keeps failing, the message is dropped
+	for the webhook and counted in stats; subscribers get it all the same.
+	Webhooks see the messages of a channel roughly in order, but with more
+	than one worker a retry can put one behind the next.
+
+	As anyone can create channels, a webhook is a way to have martd POST to
+	any url, internal services and cloud metadata endpoints too. So over
+	http a channel only gets a webhook with the admin key, or to a host in
+	-webhook-hosts. And whoever set it up, webhooks are never posted to
+	loopback, private or link local addresses, unless -webhook-private,
+	which is checked on connecting, so names resolving there do not slip
+	through either.
+*/
+
+var (
+	WebhookQueue   int
+	WebhookWorkers int
+	WebhookRetries int
+	WebhookTimeout time.Duration
+	WebhookHosts   string
+	WebhookPrivate bool
+
+	nWebhookSent    = expvar.NewInt("nWebhookSent")
+	nWebhookFailed  = expvar.NewInt("nWebhookFailed")
+	nWebhookDropped = expvar.NewInt("nWebhookDropped")
+
+	webhookCh   chan *hookMessage
+	webhookOnce sync.Once
+)
+
+func init() {
+	flag.IntVar(
+		&WebhookQueue, "webhook-queue", 1024,
+		"Most messages waiting to be sent to webhooks.",
+	)
+	flag.IntVar(
+		&WebhookWorkers, "webhook-workers", 4,
+		"Goroutines sending messages to webhooks.",
+	)
+	flag.IntVar(
+		&WebhookRetries, "webhook-retries", 3,
+		"Times to retry a failed webhook before dropping the message.",
+	)
+	flag.DurationVar(
+		&WebhookTimeout, "webhook-timeout", 5*time.Second,
+		"How long to wait on a webhook.",
+	)
+	flag.StringVar(
+		&WebhookHosts, "webhook-hosts", "",
+		"Comma separated hosts anyone may point webhooks at, others need -admin-key.",
+	)
+	flag.BoolVar(
+		&WebhookPrivate, "webhook-private", false,
+		"Let webhooks post to loopback, private and link local addresses.",
+	)
+}
+
+// hookMessage is what a webhook gets.
+type hookMessage struct {
+	Channel  string            `json:"channel"`
+	Etag     string            `json:"etag"`
+	Data     string            `json:"data"`
+	ID       string            `json:"id,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Encoding string            `json:"encoding,omitempty"` // of data, "base64" or ""
+
+	ch  *Channel
+	url string
+}
+
+// validWebhook tells if u can be posted to.
+func validWebhook(u string) bool {
+	p, err := url.Parse(u)
+	return err == nil && (p.Scheme == "http" || p.Scheme == "https") &&
+		p.Host != ""
+}
+
+// canSetWebhook tells if the client of r may have channel name post to u.
+// A channel that has u already keeps it, clients repeat all attributes.
+func canSetWebhook(r *http.Request, name, u string) error {
+	if u == "" {
+		return nil
+	}
+	if ch := existingChannel(name); ch != nil {
+		ch.lock.RLock()
+		has := ch.Webhook == u
+		ch.lock.RUnlock()
+		if has {
+			return nil
+		}
+	}
+	return allowWebhook(u, r.FormValue("admin_key"))
+}
+
+// allowWebhook tells if a client with adminKey may give a channel webhook
+// u.
+func allowWebhook(u, adminKey string) error {
+	if CheckAdminKey(adminKey) == nil {
+		return nil
+	}
+	p, err := url.Parse(u)
+	if err != nil {
+		return ErrBadWebhook
+	}
+	for _, h := range strings.Split(WebhookHosts, ",") {
+		if h = strings.TrimSpace(h); h != "" && strings.EqualFold(h, p.Hostname()) {
+			return nil
+		}
+	}
+	return ErrWebhookNotAllowed
+}
+
+// publicOnly refuses connections to addresses webhooks must not reach, see
+// WebhookPrivate. It is a net.Dialer Control, address is an ip:port.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	if WebhookPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return errors.New("webhook to private address " + host + " refused")
+	}
+	return nil
+}
+
+// webhook queues m for the webhook of the channel, if it has one. It never
+// waits. Must be called with c.lock held.
+func (c *Channel) webhook(m *Message) {
+	if c.Webhook == "" {
+		return
+	}
+	webhookOnce.Do(startWebhooks)
+
+	h := &hookMessage{
+		Channel: c.Name, Etag: fmt.Sprintf("%d", m.Created),
+		Data: c.encode(m.Data), ID: m.ID, Headers: m.Headers,
+		Encoding: c.encoding(), ch: c, url: c.Webhook,
+	}
+	select {
+	case webhookCh <- h:
+	default:
+		nWebhookDropped.Add(1)
+		atomic.AddInt64(&c.hookFailed, 1)
+		warnf("webhook queue full, dropped %s %s", c.Name, h.Etag)
+	}
+}
+
+func startWebhooks() {
+	webhookCh = make(chan *hookMessage, WebhookQueue)
+	dialer := &net.Dialer{Timeout: WebhookTimeout, Control: publicOnly}
+	client := &http.Client{
+		Timeout: WebhookTimeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext, Proxy: http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: WebhookTimeout,
+		},
+	}
+	for i := 0; i < WebhookWorkers || i == 0; i++ {
+		go func() {
+			for h := range webhookCh {
+				h.send(client)
+			}
+		}()
+	}
+}
+
+// send posts h, retrying with backoff.
+func (h *hookMessage) send(client *http.Client) {
+	j, err := json.Marshal(h)
+	if err != nil {
+		return
+	}
+
+	wait := 100 * time.Millisecond
+	for try := 0; ; try++ {
+		err = h.post(client, j)
+		if err == nil {
+			nWebhookSent.Add(1)
+			return
+		}
+		if try >= WebhookRetries {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	nWebhookFailed.Add(1)
+	atomic.AddInt64(&h.ch.hookFailed, 1)
+	warnf("webhook %s for %s %s failed: %s", h.url, h.Channel, h.Etag, err)
+}
+
+func (h *hookMessage) post(client *http.Client, j []byte) error {
+	resp, err := client.Post(h.url, "application/json", bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/*
+	/ws takes the same query as /sub, but instead of one response the
+	connection stays open and the client gets a text frame, a SubResponse
+	json, every time there is something new. Backlog after the given etags
+	comes first, then live messages.
+
+	This is just enough of RFC 6455 for that: text frames out, and ping and
+	close handled on the way in. Anything else the client sends is ignored.
+*/
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	lock sync.Mutex // for writes
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("not a websocket request")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("Sec-WebSocket-Key missing")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("server issue, handler does not support Hijacker")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(
+		rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(h[:]),
+	)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func (ws *wsConn) write(opcode byte, data []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	hdr := []byte{0x80 | opcode}
+	switch n := len(data); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, 126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr = append(hdr, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+
+	if _, err := ws.rw.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(data); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+func (ws *wsConn) writeJSON(v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.write(wsText, j)
+}
+
+// readLoop answers pings, and returns once the client closes the
+// connection or it breaks.
+func (ws *wsConn) readLoop() {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(ws.rw, hdr[:]); err != nil {
+			return
+		}
+		opcode := hdr[0] & 0x0F
+
+		n := uint64(hdr[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+				return
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > 1<<20 {
+			return // we never expect big frames from clients
+		}
+
+		var mask [4]byte
+		if hdr[1]&0x80 != 0 {
+			if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+				return
+			}
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(ws.rw, data); err != nil {
+			return
+		}
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			ws.write(wsClose, nil)
+			return
+		case wsPing:
+			ws.write(wsPong, data)
+		}
+	}
+}
+
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	nSub.Add(1)
+	nSubAll.Add(1)
+	defer nSub.Add(-1)
+
+	if ShuttingDown() {
+		unavailable(w)
+		return
+	}
+
+	req, err := parseSubRequest(r)
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	if len(req.patterns) != 0 {
+		reject(w, "patterns are not supported for websockets")
+		return
+	}
+
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		reject(w, err.Error())
+		return
+	}
+	defer ws.conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ws.readLoop()
+		cancel()
+	}()
+
+	// never closed, the sender of a fanout queued before we unsubscribed
+	// may still send to it, see fanout.go
+	evch := req.opts.EventChan(len(req.etags) + 1)
+
+	if req.heartbeat != 0 {
+		defer Heartbeat(evch, req.heartbeat)()
+	}
+
+	// subscriptions are one shot, so we subscribe again after every event,
+	// with the etags we have sent so far, and MultiSub catches anything
+	// published in between.
+	for {
+		resp, subs := MultiSub(ctx, req.etags, req.opts, evch)
+		if len(resp.Channels) == 0 && resp.Error == "" {
+			resp = &SubResponse{Channels: make(map[string]*ChanResponse)}
+		wait:
+			for {
+				select {
+				case cm := <-evch:
+					if cm.Heartbeat {
+						if err := ws.write(wsPing, nil); err != nil {
+							cancel()
+						}
+						continue
+					}
+					if cm.Shutdown {
+						resp = &SubResponse{Error: ErrShuttingDown.Error()}
+						break wait
+					}
+					if cm.Reaped {
+						break wait // subscribe again, nothing to send
+					}
+					resp.Channels[cm.Chan.Name] = eventResponse(cm)
+					break wait
+				case <-ctx.Done():
+					break wait
+				}
+			}
+		}
+		MultiUnSub(subs, evch)
+
+		if ctx.Err() != nil {
+			return
+		}
+		if len(resp.Channels) == 0 && resp.Error == "" {
+			continue
+		}
+
+		for name, cr := range resp.Channels {
+			etag := int64(0)
+			fmt.Sscan(cr.Etag, &etag)
+			req.etags[name] = etag
+		}
+		if req.reverse {
+			resp.Reverse()
+		}
+		if err := ws.writeJSON(resp); err != nil {
+			log.Println("websocket write failed:", err)
+			return
+		}
+		if resp.Error != "" || ShuttingDown() {
+			return
+		}
+	}
+}